@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireAuth rejects requests that don't carry the configured --auth-token,
+// either as "Authorization: Bearer <token>" or as "X-API-Key: <token>".
+// The adapter's credentials are removed before the request is proxied.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AuthToken == "" {
+			next(w, r)
+			return
+		}
+
+		if !validClientToken(r, config.AuthToken) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gpt-oss-ollama-cline-adapter"`)
+			writeAPIError(w, http.StatusUnauthorized, "invalid_api_key", "Invalid or missing API key")
+			return
+		}
+
+		r.Header.Del("Authorization")
+		r.Header.Del("X-API-Key")
+		next(w, r)
+	}
+}
+
+// validClientToken compares the client's token with the expected one in constant time
+func validClientToken(r *http.Request, token string) bool {
+	candidates := []string{r.Header.Get("X-API-Key")}
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		candidates = append(candidates, strings.TrimSpace(auth[7:]))
+	}
+
+	valid := 0
+	for _, candidate := range candidates {
+		valid |= subtle.ConstantTimeCompare([]byte(candidate), []byte(token))
+	}
+	return valid == 1
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// cacheHeader tells clients whether a response was served from the cache
+const cacheHeader = "X-Adapter-Cache"
+
+// cachedResponse is a non-streamed 200 response stored by the cache. Its
+// header has no CORS headers, withCORS adds them for each client.
+type cachedResponse struct {
+	key     string
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// responseCache is an LRU cache of upstream responses with a fixed TTL
+type responseCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	size  int
+	order *list.List // most recently used first
+	items map[string]*list.Element
+}
+
+// responses is nil when --cache-ttl is not set
+var responses *responseCache
+
+// newResponseCache creates a cache holding at most size responses for ttl
+func newResponseCache(ttl time.Duration, size int) *responseCache {
+	return &responseCache{
+		ttl:   ttl,
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// cacheKey identifies a request by path, model and the rewritten body, which
+// includes the injected grammar, so requests with different grammars never collide
+func cacheKey(path, model string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(path))
+	h.Write([]byte{0})
+	h.Write([]byte(model))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns the response stored for key, if it hasn't expired
+func (c *responseCache) get(key string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cachedResponse)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry, true
+}
+
+// set stores a response, evicting the least recently used one when the cache is full
+func (c *responseCache) set(key string, header http.Header, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &cachedResponse{key: key, header: header, body: body, expires: time.Now().Add(c.ttl)}
+	if el, ok := c.items[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+// write sends a cached response to the client
+func (e *cachedResponse) write(w http.ResponseWriter) {
+	writeReplayedHeader(w, e.header)
+	w.Header().Set(cacheHeader, "HIT")
+	w.WriteHeader(http.StatusOK)
+	w.Write(e.body)
+}
+
+// cacheRecorder copies the response body sent to the client so it can be cached
+type cacheRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+// Write implements http.ResponseWriter
+func (cr *cacheRecorder) Write(p []byte) (int, error) {
+	cr.body.Write(p)
+	return cr.ResponseWriter.Write(p)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (cr *cacheRecorder) Unwrap() http.ResponseWriter {
+	return cr.ResponseWriter
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCacheKey(t *testing.T) {
+	key := cacheKey("/v1/chat/completions", "gpt-oss:20b", []byte(`{"a":1}`))
+	if again := cacheKey("/v1/chat/completions", "gpt-oss:20b", []byte(`{"a":1}`)); again != key {
+		t.Errorf("cacheKey is not deterministic: %q != %q", again, key)
+	}
+	for _, other := range []string{
+		cacheKey("/api/chat", "gpt-oss:20b", []byte(`{"a":1}`)),
+		cacheKey("/v1/chat/completions", "gpt-oss:120b", []byte(`{"a":1}`)),
+		cacheKey("/v1/chat/completions", "gpt-oss:20b", []byte(`{"a":2}`)),
+	} {
+		if other == key {
+			t.Errorf("different requests share the key %q", key)
+		}
+	}
+}
+
+func TestResponseCacheEvictsAndExpires(t *testing.T) {
+	c := newResponseCache(time.Hour, 2)
+	c.set("a", http.Header{}, []byte("a"))
+	c.set("b", http.Header{}, []byte("b"))
+	c.get("a")
+	c.set("c", http.Header{}, []byte("c"))
+	if _, ok := c.get("b"); ok {
+		t.Error("least recently used entry was kept")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("entry %q was evicted", key)
+		}
+	}
+
+	expired := newResponseCache(-time.Second, 2)
+	expired.set("a", http.Header{}, []byte("a"))
+	if _, ok := expired.get("a"); ok {
+		t.Error("expired entry was returned")
+	}
+}
+
+// A cached response gets the CORS headers of the client it is replayed to,
+// not those of the client that filled the cache
+func TestCachedResponseCORSHeaders(t *testing.T) {
+	upstream := newFakeOllama(t, nil)
+	cfg := testConfig()
+	cfg.CacheTTL = time.Minute
+	cfg.CORSOrigins = "https://a.example,https://b.example"
+	adapter := startAdapter(t, cfg, upstream)
+
+	body := `{"model":"gpt-oss:20b","messages":[{"role":"user","content":"hi"}]}`
+	send := func(origin string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, adapter.URL+"/v1/chat/completions", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := send("https://a.example"); resp.Header.Get(cacheHeader) != "MISS" {
+		t.Fatalf("first request: %s = %q, want MISS", cacheHeader, resp.Header.Get(cacheHeader))
+	}
+	tests := []struct {
+		origin string
+		want   string
+	}{
+		{"https://b.example", "https://b.example"},
+		{"https://evil.example", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		resp := send(tt.origin)
+		if resp.Header.Get(cacheHeader) != "HIT" {
+			t.Fatalf("origin %q: %s = %q, want HIT", tt.origin, cacheHeader, resp.Header.Get(cacheHeader))
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tt.want {
+			t.Errorf("origin %q: Access-Control-Allow-Origin = %q, want %q", tt.origin, got, tt.want)
+		}
+		if vary := resp.Header.Values("Vary"); len(vary) != 1 || vary[0] != "Origin" {
+			t.Errorf("origin %q: Vary = %q, want a single Origin", tt.origin, vary)
+		}
+	}
+	if n := len(upstream.received()); n != 1 {
+		t.Errorf("upstream received %d requests, want 1", n)
+	}
+}
+
+// Only the --inject-paths completions are cached, a repeated /api/pull has to
+// reach Ollama every time
+func TestResponseCacheSkipsOtherEndpoints(t *testing.T) {
+	upstream := newFakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success"}`))
+	})
+	cfg := testConfig()
+	cfg.CacheTTL = time.Minute
+	adapter := startAdapter(t, cfg, upstream)
+
+	body := `{"model":"gpt-oss:20b","stream":false}`
+	for i := 0; i < 2; i++ {
+		resp, _ := post(t, adapter, "/api/pull", body)
+		if got := resp.Header.Get(cacheHeader); got != "" {
+			t.Errorf("request %d: %s = %q, want none", i, cacheHeader, got)
+		}
+	}
+	if n := len(upstream.received()); n != 2 {
+		t.Errorf("upstream received %d pulls, want 2", n)
+	}
+}
+
+// Ollama's native endpoints stream unless the body says otherwise, so an
+// /api/generate request without "stream" is not cached either
+func TestResponseCacheSkipsNativeStreams(t *testing.T) {
+	upstream := newFakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Write([]byte(`{"model":"gpt-oss:20b","response":"hi","done":true}` + "\n"))
+	})
+	cfg := testConfig()
+	cfg.CacheTTL = time.Minute
+	cfg.InjectPaths = defaultInjectPaths + ",/api/generate"
+	adapter := startAdapter(t, cfg, upstream)
+
+	body := `{"model":"gpt-oss:20b","prompt":"hi"}`
+	for i := 0; i < 2; i++ {
+		resp, _ := post(t, adapter, "/api/generate", body)
+		if got := resp.Header.Get(cacheHeader); got != "" {
+			t.Errorf("request %d: %s = %q, want none", i, cacheHeader, got)
+		}
+	}
+	if n := len(upstream.received()); n != 2 {
+		t.Errorf("upstream received %d requests, want 2", n)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// coldStartMessages are the error messages Ollama answers with while a model
+// is still being loaded
+var coldStartMessages = []string{
+	"loading model",
+	"model is loading",
+	"waiting for llama runner",
+	"server busy",
+	"timeout awaiting response headers",
+}
+
+// coldStartBaseDelay is the pause before the first new attempt, doubled for every further one
+const coldStartBaseDelay = time.Second
+
+// coldStartMaxDelay bounds the pause between two attempts during a cold start
+const coldStartMaxDelay = 5 * time.Second
+
+// coldStartTransport holds requests while the upstream loads the model. As
+// long as --cold-start-grace allows, responses and errors that say the model
+// is loading, including a response header timeout, are retried instead of
+// being returned. Streams can be held too since nothing was sent yet.
+type coldStartTransport struct {
+	next      http.RoundTripper
+	grace     time.Duration
+	baseDelay time.Duration
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *coldStartTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := bufferRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	delay := t.baseDelay
+	for attempt := 1; ; attempt++ {
+		resp, err := t.next.RoundTrip(replayRequest(req, body))
+		reason, loading := isColdStart(resp, err)
+		remaining := t.grace - time.Since(start)
+		if !loading || remaining <= 0 || req.Context().Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+		requestLogger(req.Context()).Info("upstream is loading the model, holding request",
+			"method", req.Method,
+			"path", req.URL.Path,
+			"attempt", attempt,
+			"reason", reason,
+			"waited", time.Since(start).Round(time.Millisecond),
+			"grace", t.grace)
+
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if delay *= 2; delay > coldStartMaxDelay {
+			delay = coldStartMaxDelay
+		}
+	}
+}
+
+// isColdStart reports whether an upstream result says the model is still
+// loading, along with the message that says so. The body of error responses
+// is read and put back for the caller.
+func isColdStart(resp *http.Response, err error) (string, bool) {
+	if err != nil {
+		return err.Error(), isColdStartMessage(err.Error())
+	}
+	if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return "", false
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return "", false
+	}
+	data, readErr := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = &nopCloser{reader: bytes.NewReader(data)}
+	if readErr != nil {
+		return "", false
+	}
+	message := strings.TrimSpace(string(data))
+	return message, isColdStartMessage(message)
+}
+
+// isColdStartMessage reports whether a message matches one of coldStartMessages
+func isColdStartMessage(message string) bool {
+	lower := strings.ToLower(message)
+	for _, m := range coldStartMessages {
+		if strings.Contains(lower, m) {
+			return true
+		}
+	}
+	return false
+}
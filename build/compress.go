@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressStream gzips a filtered stream for clients that accept it, with
+// --compress-streams. Every piece of the stream is flushed through the
+// compressor as it arrives, so events still reach the client one at a time.
+func compressStream(resp *http.Response) {
+	if !config.CompressStreams || !acceptsGzip(resp.Request) ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return
+	}
+	resp.Body = newGzipStreamReader(resp.Body)
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Add("Vary", "Accept-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+}
+
+// acceptsGzip reports whether the client's Accept-Encoding allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "gzip" && coding != "*" {
+				continue
+			}
+			// gzip;q=0 refuses it
+			q := 1.0
+			if name, weight, ok := strings.Cut(params, "="); ok && strings.TrimSpace(name) == "q" {
+				q, _ = strconv.ParseFloat(strings.TrimSpace(weight), 64)
+			}
+			return q > 0
+		}
+	}
+	return false
+}
+
+// gzipStreamReader compresses a body as it is read, flushing the compressor
+// after every read of the body so nothing is held back
+type gzipStreamReader struct {
+	src io.ReadCloser
+	gz  *gzip.Writer
+	out bytes.Buffer
+	buf []byte
+	err error
+}
+
+// newGzipStreamReader wraps a body to be sent gzip compressed
+func newGzipStreamReader(src io.ReadCloser) *gzipStreamReader {
+	r := &gzipStreamReader{src: src, buf: make([]byte, 32<<10)}
+	r.gz = gzip.NewWriter(&r.out)
+	return r
+}
+
+// Read implements io.Reader
+func (r *gzipStreamReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 && r.err == nil {
+		n, err := r.src.Read(r.buf)
+		if n > 0 {
+			r.gz.Write(r.buf[:n])
+			r.gz.Flush()
+		}
+		if err != nil {
+			r.gz.Close()
+			r.err = err
+		}
+	}
+	if r.out.Len() > 0 {
+		return r.out.Read(p)
+	}
+	return 0, r.err
+}
+
+// Close implements io.Closer
+func (r *gzipStreamReader) Close() error {
+	return r.src.Close()
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the resolved adapter settings.
+// Precedence is flags > environment variables > config file > defaults.
+type Config struct {
+	TargetBaseURL              string        `yaml:"target"`
+	ListenHost                 string        `yaml:"host"`
+	ListenPort                 string        `yaml:"port"`
+	GrammarFile                string        `yaml:"grammar_file"`
+	GrammarMap                 string        `yaml:"grammar_map"`
+	GrammarPolicy              string        `yaml:"grammar_policy"`
+	LogLevel                   string        `yaml:"log_level"`
+	ShutdownTimeout            time.Duration `yaml:"shutdown_timeout"`
+	UpstreamTimeout            time.Duration `yaml:"upstream_timeout"`
+	DialTimeout                time.Duration `yaml:"dial_timeout"`
+	ResponseHeaderTimeout      time.Duration `yaml:"response_header_timeout"`
+	MaxRetries                 int           `yaml:"max_retries"`
+	HealthzCheckUpstream       bool          `yaml:"healthz_check_upstream"`
+	Metrics                    bool          `yaml:"metrics"`
+	WatchGrammar               bool          `yaml:"watch_grammar"`
+	WatchInterval              time.Duration `yaml:"watch_interval"`
+	StrictGrammar              bool          `yaml:"strict_grammar"`
+	UpstreamAPIKey             string        `yaml:"upstream_api_key"`
+	AuthToken                  string        `yaml:"auth_token"`
+	GenerateGrammar            bool          `yaml:"generate_grammar"`
+	Balance                    string        `yaml:"balance"`
+	PreserveHost               bool          `yaml:"preserve_host"`
+	MaxConcurrency             int           `yaml:"max_concurrency"`
+	MaxQueue                   int           `yaml:"max_queue"`
+	OverflowPolicy             string        `yaml:"overflow_policy"`
+	CacheTTL                   time.Duration `yaml:"cache_ttl"`
+	CacheSize                  int           `yaml:"cache_size"`
+	LogRedact                  bool          `yaml:"log_redact"`
+	TLSCert                    string        `yaml:"tls_cert"`
+	TLSKey                     string        `yaml:"tls_key"`
+	ListModels                 bool          `yaml:"list_models"`
+	GrammarModels              string        `yaml:"grammar_models"`
+	DisableForModels           string        `yaml:"disable_for_models"`
+	InjectKey                  string        `yaml:"inject_key"`
+	MaxBodySize                int64         `yaml:"max_body_size"`
+	NoInjectOnEmptyTools       bool          `yaml:"no_inject_on_empty_tools"`
+	SystemPrefix               string        `yaml:"system_prefix"`
+	SystemPrefixFile           string        `yaml:"system_prefix_file"`
+	MaxAnalysisChars           int           `yaml:"max_analysis_chars"`
+	GrammarDirs                string        `yaml:"grammar_dirs"`
+	MaxIdleConns               int           `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost        int           `yaml:"max_idle_conns_per_host"`
+	IdleConnTimeout            time.Duration `yaml:"idle_conn_timeout"`
+	PassthroughPaths           string        `yaml:"passthrough_paths"`
+	CORSOrigins                string        `yaml:"cors_origins"`
+	StreamUsage                bool          `yaml:"stream_usage"`
+	FallbackNoGrammar          bool          `yaml:"fallback_no_grammar"`
+	RoleMap                    string        `yaml:"role_map"`
+	TargetPathPrefix           string        `yaml:"target_path_prefix"`
+	StripPrefix                string        `yaml:"strip_prefix"`
+	StreamIdleTimeout          time.Duration `yaml:"stream_idle_timeout"`
+	ExposeGrammarHeader        bool          `yaml:"expose_grammar_header"`
+	AccessLogFormat            string        `yaml:"access_log_format"`
+	DisableTransforms          string        `yaml:"disable_transforms"`
+	MaxToolCalls               int           `yaml:"max_tool_calls"`
+	InjectPaths                string        `yaml:"inject_paths"`
+	TestGrammar                string        `yaml:"-"` // command-line only, see runGrammarTest
+	ToolCallTemperature        float64       `yaml:"tool_call_temperature"`
+	DebugEndpoints             bool          `yaml:"debug_endpoints"`
+	DebugHistory               int           `yaml:"debug_history"`
+	H2C                        bool          `yaml:"h2c"`
+	UpstreamInsecureSkipVerify bool          `yaml:"upstream_insecure_skip_verify"`
+	UpstreamCAFile             string        `yaml:"upstream_ca_file"`
+	DedupeRequests             bool          `yaml:"dedupe_requests"`
+	ColdStartGrace             time.Duration `yaml:"cold_start_grace"`
+	AllowRequestOverrides      bool          `yaml:"allow_request_overrides"`
+	ReadHeaderTimeout          time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout                time.Duration `yaml:"read_timeout"`
+	WriteTimeout               time.Duration `yaml:"write_timeout"`
+	MaxHeaderBytes             int           `yaml:"max_header_bytes"`
+	ToolGrammar                string        `yaml:"tool_grammar"`
+	ChatGrammar                string        `yaml:"chat_grammar"`
+	FinalChannels              string        `yaml:"final_channels"`
+	FinalSeparator             string        `yaml:"final_separator"`
+	Mock                       bool          `yaml:"mock"`
+	MockDir                    string        `yaml:"mock_dir"`
+	EnablePriorityQueue        bool          `yaml:"enable_priority_queue"`
+	PriorityModels             string        `yaml:"priority_models"`
+	CompressStreams            bool          `yaml:"compress_streams"`
+	StripThinking              bool          `yaml:"strip_thinking"`
+}
+
+// config is the configuration resolved at startup
+var config = defaultConfig()
+
+// defaultConfig returns the built-in defaults
+func defaultConfig() Config {
+	return Config{
+		TargetBaseURL:         "http://ollama:11434/v1",
+		ListenHost:            "0.0.0.0",
+		ListenPort:            "8000",
+		GrammarFile:           "/app/cline.gbnf",
+		GrammarPolicy:         policyFill,
+		LogLevel:              "info",
+		ShutdownTimeout:       15 * time.Second,
+		UpstreamTimeout:       10 * time.Minute,
+		DialTimeout:           10 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Minute,
+		WatchInterval:         2 * time.Second,
+		Balance:               balanceRoundRobin,
+		OverflowPolicy:        overflowQueue,
+		CacheSize:             100,
+		GrammarModels:         "gpt-oss*",
+		InjectKey:             injectKeyGrammar,
+		MaxBodySize:           10 << 20,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+		RoleMap:               defaultRoleMap,
+		AccessLogFormat:       accessLogText,
+		InjectPaths:           defaultInjectPaths,
+		ToolCallTemperature:   -1,
+		DebugHistory:          10,
+		ReadHeaderTimeout:     10 * time.Second,
+		ReadTimeout:           time.Minute,
+		WriteTimeout:          15 * time.Minute,
+		MaxHeaderBytes:        64 << 10,
+		FinalChannels:         finalChannelsLast,
+		FinalSeparator:        "\n\n",
+	}
+}
+
+// registerFlags binds the command-line flags to the given config
+func registerFlags(fs *flag.FlagSet, cfg *Config, configFile *string) {
+	fs.StringVar(configFile, "config-file", "", "Path to YAML or JSON config file")
+	fs.StringVar(&cfg.GrammarFile, "config", cfg.GrammarFile, "Path to grammar file (.gbnf)")
+	fs.StringVar(&cfg.TargetBaseURL, "target", cfg.TargetBaseURL, "Upstream base URL, or comma-separated list of URLs (overrides TARGET_BASE_URL)")
+	fs.StringVar(&cfg.Balance, "balance", cfg.Balance, "Balancing across multiple targets: round-robin, random or model")
+	fs.StringVar(&cfg.ListenHost, "host", cfg.ListenHost, "Host to listen on (overrides TOOL_CALL_ADAPTER_HOST)")
+	fs.StringVar(&cfg.ListenPort, "port", cfg.ListenPort, "Port to listen on (overrides TOOL_CALL_ADAPTER_PORT)")
+	fs.StringVar(&cfg.GrammarMap, "grammar-map", cfg.GrammarMap, "Path to JSON file mapping model name patterns to grammar files")
+	fs.StringVar(&cfg.GrammarPolicy, "grammar-policy", cfg.GrammarPolicy, "Grammar injection policy: fill, override or never")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level: debug, info, warn or error")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "Grace period for in-flight requests on shutdown")
+	fs.DurationVar(&cfg.UpstreamTimeout, "upstream-timeout", cfg.UpstreamTimeout, "Overall timeout for non-streaming upstream requests (0 disables)")
+	fs.DurationVar(&cfg.DialTimeout, "dial-timeout", cfg.DialTimeout, "Timeout for connecting to the upstream (0 disables)")
+	fs.DurationVar(&cfg.ResponseHeaderTimeout, "response-header-timeout", cfg.ResponseHeaderTimeout, "Timeout for receiving upstream response headers (0 disables)")
+	fs.IntVar(&cfg.MaxRetries, "max-retries", cfg.MaxRetries, "Retries for failed non-streaming upstream requests (connection errors, 502/503/504)")
+	fs.BoolVar(&cfg.HealthzCheckUpstream, "healthz-check-upstream", cfg.HealthzCheckUpstream, "Check upstream reachability in /healthz")
+	fs.BoolVar(&cfg.Metrics, "metrics", cfg.Metrics, "Expose Prometheus metrics at /metrics")
+	fs.BoolVar(&cfg.WatchGrammar, "watch-grammar", cfg.WatchGrammar, "Reload grammar files when they change")
+	fs.DurationVar(&cfg.WatchInterval, "watch-interval", cfg.WatchInterval, "Polling interval for --watch-grammar")
+	fs.BoolVar(&cfg.StrictGrammar, "strict-grammar", cfg.StrictGrammar, "Exit when a grammar file fails validation")
+	fs.BoolVar(&cfg.GenerateGrammar, "generate-grammar", cfg.GenerateGrammar, "Generate the grammar from each request's tools")
+	fs.StringVar(&cfg.AuthToken, "auth-token", cfg.AuthToken, "Token clients must send as a Bearer token or X-API-Key")
+	fs.StringVar(&cfg.UpstreamAPIKey, "upstream-api-key", cfg.UpstreamAPIKey, "API key sent to the upstream as a Bearer token (overrides UPSTREAM_API_KEY)")
+	fs.BoolVar(&cfg.PreserveHost, "preserve-host", cfg.PreserveHost, "Forward the client's Host header instead of the target's")
+	fs.IntVar(&cfg.MaxConcurrency, "max-concurrency", cfg.MaxConcurrency, "Maximum number of requests proxied at the same time (0 disables)")
+	fs.IntVar(&cfg.MaxQueue, "max-queue", cfg.MaxQueue, "Maximum number of requests waiting for --max-concurrency (0 is unbounded)")
+	fs.StringVar(&cfg.OverflowPolicy, "overflow-policy", cfg.OverflowPolicy, "What to do with requests over --max-concurrency: queue or reject")
+	fs.DurationVar(&cfg.CacheTTL, "cache-ttl", cfg.CacheTTL, "How long non-streamed responses are cached (0 disables the cache)")
+	fs.IntVar(&cfg.CacheSize, "cache-size", cfg.CacheSize, "Maximum number of cached responses")
+	fs.BoolVar(&cfg.LogRedact, "log-redact", cfg.LogRedact, "Replace prompt and completion text in logged bodies by its length and hash")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert, "Path to TLS certificate file, serves HTTPS together with --tls-key")
+	fs.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "Path to TLS private key file, serves HTTPS together with --tls-cert")
+	fs.BoolVar(&cfg.ListModels, "list-models", cfg.ListModels, "Mark grammar-capable models with x-adapter-grammar in model lists")
+	fs.StringVar(&cfg.GrammarModels, "grammar-models", cfg.GrammarModels, "Comma-separated model name patterns considered grammar-capable by --list-models")
+	fs.StringVar(&cfg.DisableForModels, "disable-for-models", cfg.DisableForModels, "Comma-separated model name patterns that never get a grammar injected")
+	fs.StringVar(&cfg.InjectKey, "inject-key", cfg.InjectKey, "Where the grammar is injected: options.grammar or format (JSON schema grammars only)")
+	fs.Int64Var(&cfg.MaxBodySize, "max-body-size", cfg.MaxBodySize, "Maximum request body size in bytes (0 disables the limit)")
+	fs.BoolVar(&cfg.NoInjectOnEmptyTools, "no-inject-on-empty-tools", cfg.NoInjectOnEmptyTools, "Skip grammar injection for requests without tools")
+	fs.StringVar(&cfg.SystemPrefix, "system-prefix", cfg.SystemPrefix, "Text prepended to the system message of requests that get the grammar")
+	fs.StringVar(&cfg.SystemPrefixFile, "system-prefix-file", cfg.SystemPrefixFile, "File holding the --system-prefix text")
+	fs.IntVar(&cfg.MaxAnalysisChars, "max-analysis-chars", cfg.MaxAnalysisChars, "Truncate analysis channel text after this many characters (0 is unlimited)")
+	fs.StringVar(&cfg.GrammarDirs, "grammar-dirs", cfg.GrammarDirs, "Comma-separated directories X-Adapter-Grammar-File may select grammars from")
+	fs.IntVar(&cfg.MaxIdleConns, "max-idle-conns", cfg.MaxIdleConns, "Maximum idle upstream connections across all targets (0 is unlimited)")
+	fs.IntVar(&cfg.MaxIdleConnsPerHost, "max-idle-conns-per-host", cfg.MaxIdleConnsPerHost, "Maximum idle upstream connections per target")
+	fs.DurationVar(&cfg.IdleConnTimeout, "idle-conn-timeout", cfg.IdleConnTimeout, "How long idle upstream connections are kept open (0 keeps them forever)")
+	fs.StringVar(&cfg.PassthroughPaths, "passthrough-paths", cfg.PassthroughPaths, "Comma-separated path prefixes that are proxied, others get 404 (default: all)")
+	fs.StringVar(&cfg.CORSOrigins, "cors-origins", cfg.CORSOrigins, "Comma-separated browser origins allowed through CORS, * for any (default: CORS disabled)")
+	fs.BoolVar(&cfg.StreamUsage, "stream-usage", cfg.StreamUsage, "Send the consolidated token usage of streamed responses in a frame before [DONE]")
+	fs.BoolVar(&cfg.FallbackNoGrammar, "fallback-no-grammar", cfg.FallbackNoGrammar, "Retry non-streaming requests once without the injected grammar when the grammar makes them fail")
+	fs.StringVar(&cfg.RoleMap, "role-map", cfg.RoleMap, "Comma-separated from=to pairs mapping client message roles to the roles sent upstream")
+	fs.StringVar(&cfg.TargetPathPrefix, "target-path-prefix", cfg.TargetPathPrefix, "Path prefix prepended to proxied request paths, for upstreams not mounted at the root")
+	fs.StringVar(&cfg.StripPrefix, "strip-prefix", cfg.StripPrefix, "Path prefix removed from request paths before they are proxied")
+	fs.DurationVar(&cfg.StreamIdleTimeout, "stream-idle-timeout", cfg.StreamIdleTimeout, "Close streams the upstream sends nothing on for this long (0 disables)")
+	fs.BoolVar(&cfg.ExposeGrammarHeader, "expose-grammar-header", cfg.ExposeGrammarHeader, "Name the source of the injected grammar in the X-Adapter-Grammar-Source response header")
+	fs.StringVar(&cfg.AccessLogFormat, "access-log-format", cfg.AccessLogFormat, "Access log format: text or json (one JSON object per request)")
+	fs.StringVar(&cfg.DisableTransforms, "disable-transforms", cfg.DisableTransforms, "Comma-separated transforms to turn off: grammar, roles, assistant-history, strip-thinking, tool-results, tool-temperature, upstream-errors, models, harmony-stream, harmony")
+	fs.IntVar(&cfg.MaxToolCalls, "max-tool-calls", cfg.MaxToolCalls, "Keep at most this many tool calls per non-streamed choice, dropping the rest (0 is unlimited)")
+	fs.StringVar(&cfg.TestGrammar, "test-grammar", cfg.TestGrammar, "Check the model output in this file against the grammar and exit")
+	fs.StringVar(&cfg.InjectPaths, "inject-paths", cfg.InjectPaths, "Comma-separated endpoints that get the grammar injected, other requests are proxied untouched")
+	fs.Float64Var(&cfg.ToolCallTemperature, "tool-call-temperature", cfg.ToolCallTemperature, "Sampling temperature for requests with tools that get the grammar (negative keeps the client's)")
+	fs.BoolVar(&cfg.DebugEndpoints, "debug-endpoints", cfg.DebugEndpoints, "Serve the last proxied requests and responses on /debug/last-request")
+	fs.IntVar(&cfg.DebugHistory, "debug-history", cfg.DebugHistory, "Number of requests kept for /debug/last-request")
+	fs.BoolVar(&cfg.H2C, "h2c", cfg.H2C, "Accept cleartext HTTP/2 (h2c) besides HTTP/1.1, for TLS terminated in front of the adapter")
+	fs.BoolVar(&cfg.UpstreamInsecureSkipVerify, "upstream-insecure-skip-verify", cfg.UpstreamInsecureSkipVerify, "Don't verify the TLS certificate of HTTPS upstreams (insecure)")
+	fs.StringVar(&cfg.UpstreamCAFile, "upstream-ca-file", cfg.UpstreamCAFile, "PEM file with CA certificates trusted for HTTPS upstreams, besides the system roots")
+	fs.BoolVar(&cfg.DedupeRequests, "dedupe-requests", cfg.DedupeRequests, "Let identical concurrent non-streamed requests share one upstream call")
+	fs.DurationVar(&cfg.ColdStartGrace, "cold-start-grace", cfg.ColdStartGrace, "How long to hold requests while the upstream loads the model, retrying its loading errors (0 disables)")
+	fs.BoolVar(&cfg.AllowRequestOverrides, "allow-request-overrides", cfg.AllowRequestOverrides, "Let requests skip the grammar with the X-Adapter-Disable-Grammar: true header")
+	fs.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", cfg.ReadHeaderTimeout, "Timeout for reading the headers of client requests (0 disables)")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", cfg.ReadTimeout, "Timeout for reading client requests, body included (0 disables)")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", cfg.WriteTimeout, "Timeout for writing non-streamed responses (0 disables)")
+	fs.IntVar(&cfg.MaxHeaderBytes, "max-header-bytes", cfg.MaxHeaderBytes, "Maximum size of client request headers in bytes")
+	fs.StringVar(&cfg.ToolGrammar, "tool-grammar", cfg.ToolGrammar, "Path to the grammar file for requests with tools, instead of --config")
+	fs.StringVar(&cfg.ChatGrammar, "chat-grammar", cfg.ChatGrammar, "Path to the grammar file for requests without tools, instead of --config")
+	fs.StringVar(&cfg.FinalChannels, "final-channels", cfg.FinalChannels, "How several final channel messages in one completion are combined: last or join")
+	fs.StringVar(&cfg.FinalSeparator, "final-separator", cfg.FinalSeparator, "Separator between final channel messages joined with --final-channels join")
+	fs.BoolVar(&cfg.Mock, "mock", cfg.Mock, "Answer with canned completions instead of proxying to the upstream")
+	fs.StringVar(&cfg.MockDir, "mock-dir", cfg.MockDir, "Directory with chat.txt and tool_call.txt fixtures replacing the canned --mock output")
+	fs.BoolVar(&cfg.EnablePriorityQueue, "enable-priority-queue", cfg.EnablePriorityQueue, "Give requests waiting for --max-concurrency slots their slot by priority (X-Adapter-Priority header or --priority-models)")
+	fs.StringVar(&cfg.PriorityModels, "priority-models", cfg.PriorityModels, "Comma-separated pattern=priority pairs giving the default priority of models")
+	fs.BoolVar(&cfg.CompressStreams, "compress-streams", cfg.CompressStreams, "Gzip filtered streams for clients sending Accept-Encoding: gzip")
+	fs.BoolVar(&cfg.StripThinking, "strip-thinking", cfg.StripThinking, "Remove the reasoning of earlier assistant turns from the history sent upstream")
+}
+
+// loadConfig merges the built-in defaults, the config file, the environment
+// variables and the command-line flags into a single Config
+func loadConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+
+	// First pass only finds the config file and reports bad flags
+	var configFile string
+	probe := cfg
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	registerFlags(fs, &probe, &configFile)
+	fs.Parse(args)
+
+	if configFile != "" {
+		if err := readConfigFile(configFile, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	applyEnv(&cfg)
+
+	// Second pass applies only the flags that were given, on top of everything else
+	fs = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	registerFlags(fs, &cfg, &configFile)
+	fs.Parse(args)
+
+	// Grammar paths may be templated per deployment, e.g. /configs/${MODEL_FAMILY}/cline.gbnf
+	cfg.GrammarFile = expandPath(cfg.GrammarFile)
+	cfg.GrammarMap = expandPath(cfg.GrammarMap)
+	cfg.ToolGrammar = expandPath(cfg.ToolGrammar)
+	cfg.ChatGrammar = expandPath(cfg.ChatGrammar)
+	cfg.MockDir = expandPath(cfg.MockDir)
+
+	return cfg, cfg.validate()
+}
+
+// expandPath substitutes $VAR and ${VAR} references to environment variables
+// that are set. References to unset variables and a $ that doesn't start a
+// reference are kept as written, so paths containing a literal $ still work.
+func expandPath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] != '$' {
+			b.WriteByte(p[i])
+			continue
+		}
+		name, width := envReference(p[i+1:])
+		if value, ok := os.LookupEnv(name); name != "" && ok {
+			b.WriteString(value)
+			i += width
+			continue
+		}
+		b.WriteByte('$')
+	}
+	return b.String()
+}
+
+// envReference returns the variable name referenced at the start of s (the
+// text after a $) and the length of the reference
+func envReference(s string) (string, int) {
+	if strings.HasPrefix(s, "{") {
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return "", 0
+		}
+		return s[1:end], end + 1
+	}
+	n := 0
+	for n < len(s) && (s[n] == '_' || 'a' <= s[n] && s[n] <= 'z' || 'A' <= s[n] && s[n] <= 'Z' || n > 0 && '0' <= s[n] && s[n] <= '9') {
+		n++
+	}
+	return s[:n], n
+}
+
+// readConfigFile decodes a YAML or JSON config file over the given config.
+// Keys missing from the file keep their current values.
+func readConfigFile(configPath string, cfg *Config) error {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %v", err)
+	}
+	// YAML is a superset of JSON, so one decoder handles both
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("could not parse config file %s: %v", configPath, err)
+	}
+	return nil
+}
+
+// applyEnv overrides the config with the environment variables that are set
+func applyEnv(cfg *Config) {
+	if v := os.Getenv("TARGET_BASE_URL"); v != "" {
+		cfg.TargetBaseURL = v
+	}
+	if v := os.Getenv("TOOL_CALL_ADAPTER_HOST"); v != "" {
+		cfg.ListenHost = v
+	}
+	if v := os.Getenv("TOOL_CALL_ADAPTER_PORT"); v != "" {
+		cfg.ListenPort = v
+	}
+	if v := os.Getenv("GRAMMAR_FILE_PATH"); v != "" {
+		cfg.GrammarFile = v
+	}
+	if v := os.Getenv("UPSTREAM_API_KEY"); v != "" {
+		cfg.UpstreamAPIKey = v
+	}
+}
+
+// validate rejects settings with invalid values
+func (c Config) validate() error {
+	switch c.GrammarPolicy {
+	case policyFill, policyOverride, policyNever:
+	default:
+		return fmt.Errorf("invalid grammar policy %q (expected fill, override or never)", c.GrammarPolicy)
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		return fmt.Errorf("invalid log level %q (expected debug, info, warn or error)", c.LogLevel)
+	}
+	switch c.AccessLogFormat {
+	case accessLogText, accessLogJSON:
+	default:
+		return fmt.Errorf("invalid access log format %q (expected text or json)", c.AccessLogFormat)
+	}
+	switch c.Balance {
+	case balanceRoundRobin, balanceRandom, balanceModel:
+	default:
+		return fmt.Errorf("invalid balance strategy %q (expected round-robin, random or model)", c.Balance)
+	}
+	switch c.InjectKey {
+	case injectKeyGrammar, injectKeyFormat:
+	default:
+		return fmt.Errorf("invalid inject key %q (expected options.grammar or format)", c.InjectKey)
+	}
+	switch c.FinalChannels {
+	case finalChannelsLast, finalChannelsJoin:
+	default:
+		return fmt.Errorf("invalid final channels mode %q (expected last or join)", c.FinalChannels)
+	}
+	switch c.OverflowPolicy {
+	case overflowQueue, overflowReject:
+	default:
+		return fmt.Errorf("invalid overflow policy %q (expected queue or reject)", c.OverflowPolicy)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("--tls-cert and --tls-key must be set together")
+	}
+	if c.CacheTTL > 0 && c.CacheSize <= 0 {
+		return fmt.Errorf("invalid cache size %d (must be positive)", c.CacheSize)
+	}
+	if c.MaxIdleConns < 0 || c.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("idle connection limits must not be negative")
+	}
+	if c.MaxHeaderBytes <= 0 {
+		return fmt.Errorf("invalid max header bytes %d (must be positive)", c.MaxHeaderBytes)
+	}
+	if c.MaxConcurrency < 0 || c.MaxQueue < 0 {
+		return fmt.Errorf("max concurrency and max queue must not be negative")
+	}
+	for _, prefix := range []string{c.TargetPathPrefix, c.StripPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("invalid path prefix %q (must start with /)", prefix)
+		}
+	}
+	if c.WatchGrammar && c.WatchInterval <= 0 {
+		return fmt.Errorf("invalid watch interval %s (must be positive)", c.WatchInterval)
+	}
+	if c.H2C && c.TLSCert != "" {
+		return fmt.Errorf("--h2c is for cleartext listeners, TLS listeners negotiate HTTP/2 on their own")
+	}
+	if c.EnablePriorityQueue && c.MaxConcurrency == 0 {
+		return fmt.Errorf("--enable-priority-queue requires --max-concurrency")
+	}
+	if c.MockDir != "" && !c.Mock {
+		return fmt.Errorf("--mock-dir requires --mock")
+	}
+	if c.DebugEndpoints && c.DebugHistory <= 0 {
+		return fmt.Errorf("invalid debug history %d (must be positive)", c.DebugHistory)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsOrigins are the --cors-origins origins (split once at startup), "*" allows any origin
+var corsOrigins []string
+
+// corsMaxAge is how long, in seconds, browsers may cache a preflight answer
+const corsMaxAge = "600"
+
+// corsAllowedMethods are the methods browsers are allowed to use
+const corsAllowedMethods = "GET, POST, PUT, DELETE, OPTIONS"
+
+// corsAllowedHeaders are the request headers sent when a preflight doesn't list any
+const corsAllowedHeaders = "Authorization, Content-Type, X-API-Key, X-Request-ID, X-Adapter-Grammar-File, X-Adapter-Grammar-Inline"
+
+// corsExposedHeaders are the response headers scripts may read
+const corsExposedHeaders = "X-Request-ID, X-Adapter-Cache, Retry-After"
+
+// corsOriginAllowed reports whether a browser origin is listed in --cors-origins
+func corsOriginAllowed(origin string) bool {
+	for _, allowed := range corsOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPreflightRequest reports whether the request is a CORS preflight
+func isPreflightRequest(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// withCORS adds CORS headers for the origins in --cors-origins and answers
+// preflight requests itself, before authentication, since browsers never send
+// credentials with them. Without --cors-origins requests pass through unchanged.
+func withCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(corsOrigins) == 0 {
+			next(w, r)
+			return
+		}
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !corsOriginAllowed(origin) {
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if !isPreflightRequest(r) {
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			next(w, r)
+			return
+		}
+
+		headers := r.Header.Get("Access-Control-Request-Headers")
+		if headers == "" {
+			headers = corsAllowedHeaders
+		}
+		w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+		w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// withoutCORS returns a copy of a response header for replaying the response
+// to other clients, without the CORS headers withCORS set for this one
+func withoutCORS(h http.Header) http.Header {
+	out := h.Clone()
+	for name := range out {
+		if strings.HasPrefix(name, "Access-Control-") {
+			out.Del(name)
+		}
+	}
+	var vary []string
+	for _, v := range out.Values("Vary") {
+		if !strings.EqualFold(strings.TrimSpace(v), "Origin") {
+			vary = append(vary, v)
+		}
+	}
+	out.Del("Vary")
+	if len(vary) > 0 {
+		out["Vary"] = vary
+	}
+	return out
+}
+
+// writeReplayedHeader copies the header of a replayed response to w, keeping
+// the CORS headers withCORS already set for this client
+func writeReplayedHeader(w http.ResponseWriter, h http.Header) {
+	for name, values := range h {
+		if name == "Vary" {
+			w.Header()[name] = append(w.Header()[name], values...)
+			continue
+		}
+		w.Header()[name] = values
+	}
+}
+
+// stripUpstreamCORS removes the upstream's own CORS headers, which would
+// otherwise be sent next to the adapter's, when the adapter handles CORS
+func stripUpstreamCORS(h http.Header) {
+	if len(corsOrigins) == 0 {
+		return
+	}
+	for name := range h {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), "Access-Control-") {
+			h.Del(name)
+		}
+	}
+}
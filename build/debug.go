@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// debugBodyLimit bounds each body kept in the debug history
+const debugBodyLimit = 64 << 10
+
+// debugExchange is a proxied request and its response as kept for /debug/last-request
+type debugExchange struct {
+	Time          time.Time        `json:"time"`
+	RequestID     string           `json:"request_id,omitempty"`
+	Method        string           `json:"method"`
+	Path          string           `json:"path"`
+	Model         string           `json:"model,omitempty"`
+	Status        int              `json:"status"`
+	DurationMS    int64            `json:"duration_ms"`
+	Decision      *rewriteDecision `json:"decision,omitempty"`
+	RequestBody   string           `json:"request_body,omitempty"`
+	RewrittenBody string           `json:"rewritten_body,omitempty"`
+	UpstreamBody  string           `json:"upstream_body,omitempty"`
+	ResponseBody  string           `json:"response_body,omitempty"`
+
+	upstream limitedBuffer // the upstream response body, before the response transforms
+	response limitedBuffer // the response body sent to the client
+}
+
+// debugHistory is a ring buffer of the last exchanges
+type debugHistory struct {
+	mu      sync.Mutex
+	entries []*debugExchange
+	next    int
+}
+
+// debugRequests holds the history served by /debug/last-request, nil without --debug-endpoints
+var debugRequests *debugHistory
+
+// newDebugHistory creates a history keeping the last size exchanges
+func newDebugHistory(size int) *debugHistory {
+	return &debugHistory{entries: make([]*debugExchange, 0, size)}
+}
+
+// add records a finished exchange, replacing the oldest one when the history is full
+func (h *debugHistory) add(e *debugExchange) {
+	e.UpstreamBody = e.upstream.String()
+	e.ResponseBody = e.response.String()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) < cap(h.entries) {
+		h.entries = append(h.entries, e)
+		return
+	}
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % len(h.entries)
+}
+
+// list returns the recorded exchanges, newest first
+func (h *debugHistory) list() []*debugExchange {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]*debugExchange, 0, len(h.entries))
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		out = append(out, h.entries[(h.next+i)%len(h.entries)])
+	}
+	return out
+}
+
+// handleDebugLastRequest serves the debug history as JSON. Bodies go through
+// loggedBody, so --log-redact applies to them like to the logs.
+func handleDebugLastRequest(w http.ResponseWriter, r *http.Request) {
+	exchanges := debugRequests.list()
+	out := make([]debugExchange, 0, len(exchanges))
+	for _, e := range exchanges {
+		c := *e
+		c.RequestBody = loggedDebugBody(c.RequestBody)
+		c.RewrittenBody = loggedDebugBody(c.RewrittenBody)
+		c.UpstreamBody = loggedDebugBody(c.UpstreamBody)
+		c.ResponseBody = loggedDebugBody(c.ResponseBody)
+		out = append(out, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Requests []debugExchange `json:"requests"`
+	}{out})
+}
+
+// loggedDebugBody redacts a recorded body, leaving empty bodies empty
+func loggedDebugBody(body string) string {
+	if body == "" {
+		return ""
+	}
+	return loggedBody([]byte(body))
+}
+
+// debugBody returns the start of a body for the debug history
+func debugBody(body []byte) string {
+	if len(body) > debugBodyLimit {
+		body = body[:debugBodyLimit]
+	}
+	return string(body)
+}
+
+// debugExchangeFrom returns the exchange the handler records for the request, if any
+func debugExchangeFrom(ctx context.Context) *debugExchange {
+	e, _ := ctx.Value(debugContextKey).(*debugExchange)
+	return e
+}
+
+// captureUpstreamBody copies the upstream response body into the request's
+// debug exchange as the proxy reads it. Compressed bodies are not copied.
+func captureUpstreamBody(resp *http.Response) {
+	e := debugExchangeFrom(resp.Request.Context())
+	if e == nil {
+		return
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return
+	}
+	resp.Body = &teeReadCloser{ReadCloser: resp.Body, w: &e.upstream}
+}
+
+// limitedBuffer keeps the first debugBodyLimit bytes written to it
+type limitedBuffer struct {
+	buf bytes.Buffer
+}
+
+// Write implements io.Writer, never failing so the copied stream isn't affected
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := debugBodyLimit - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// String returns the kept bytes
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
+
+// teeReadCloser copies everything read from a body to w
+type teeReadCloser struct {
+	io.ReadCloser
+	w io.Writer
+}
+
+// Read implements io.Reader
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		t.w.Write(p[:n])
+	}
+	return n, err
+}
+
+// debugRecorder copies the response body sent to the client into the debug exchange
+type debugRecorder struct {
+	http.ResponseWriter
+	exchange *debugExchange
+}
+
+// Write implements http.ResponseWriter
+func (dr *debugRecorder) Write(p []byte) (int, error) {
+	dr.exchange.response.Write(p)
+	return dr.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher
+func (dr *debugRecorder) Flush() {
+	if f, ok := dr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (dr *debugRecorder) Unwrap() http.ResponseWriter {
+	return dr.ResponseWriter
+}
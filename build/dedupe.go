@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// dedupeHeader marks responses shared from an identical request that was already in flight
+const dedupeHeader = "X-Adapter-Deduplicated"
+
+// requestFlight is a non-streamed upstream request other identical requests wait for
+type requestFlight struct {
+	done   chan struct{}
+	ok     bool // the response is complete and may be shared
+	status int
+	header http.Header
+	body   []byte
+}
+
+// requestFlights tracks the non-streamed requests currently sent upstream,
+// keyed like the response cache, so concurrent identical requests share one
+// upstream call
+type requestFlights struct {
+	mu    sync.Mutex
+	calls map[string]*requestFlight
+}
+
+// flights is nil without --dedupe-requests
+var flights *requestFlights
+
+// newRequestFlights creates an empty set of requests in flight
+func newRequestFlights() *requestFlights {
+	return &requestFlights{calls: make(map[string]*requestFlight)}
+}
+
+// join returns the call in flight for key. The first caller becomes the
+// leader, which sends the request and must call finish.
+func (g *requestFlights) join(key string) (*requestFlight, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if call, ok := g.calls[key]; ok {
+		return call, false
+	}
+	call := &requestFlight{done: make(chan struct{})}
+	g.calls[key] = call
+	return call, true
+}
+
+// finish hands the leader's response to the waiting requests. Incomplete
+// responses, e.g. of a leader whose client went away, are not shared and
+// the waiting requests go upstream themselves.
+func (g *requestFlights) finish(key string, call *requestFlight, ok bool, status int, header http.Header, body []byte) {
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	if ok {
+		call.ok = true
+		call.status = status
+		call.header = withoutCORS(header)
+		call.header.Del(requestIDHeader)
+		call.header.Del(cacheHeader)
+		call.body = body
+	}
+	close(call.done)
+}
+
+// wait blocks until the leader finished, reporting whether its response can be shared
+func (call *requestFlight) wait(ctx context.Context) bool {
+	select {
+	case <-call.done:
+		return call.ok
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// write sends the shared response to the client
+func (call *requestFlight) write(w http.ResponseWriter) {
+	writeReplayedHeader(w, call.header)
+	w.Header().Set(dedupeHeader, "true")
+	w.WriteHeader(call.status)
+	w.Write(call.body)
+}
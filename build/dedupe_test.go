@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDedupeIdenticalRequests(t *testing.T) {
+	release := make(chan struct{})
+	upstream := newFakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(fakeCompletion))
+	})
+	cfg := testConfig()
+	cfg.DedupeRequests = true
+	cfg.CORSOrigins = "https://a.example,https://b.example"
+	adapter := startAdapter(t, cfg, upstream)
+
+	body := `{"model":"gpt-oss:20b","messages":[{"role":"user","content":"hi"}]}`
+	origins := []string{"https://a.example", "https://b.example"}
+	responses := make([]*http.Response, len(origins))
+	bodies := make([][]byte, len(origins))
+	var wg sync.WaitGroup
+	for i, origin := range origins {
+		wg.Add(1)
+		go func(i int, origin string) {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodPost, adapter.URL+"/v1/chat/completions", bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Origin", origin)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			responses[i] = resp
+			bodies[i], _ = ioutil.ReadAll(resp.Body)
+		}(i, origin)
+		if i == 0 {
+			// The second request has to find the first one in flight
+			waitFor(t, func() bool { return len(upstream.received()) == 1 })
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	if n := len(upstream.received()); n != 1 {
+		t.Errorf("upstream received %d requests, want 1", n)
+	}
+	if !bytes.Equal(bodies[0], bodies[1]) {
+		t.Errorf("responses differ:\n%s\n%s", bodies[0], bodies[1])
+	}
+	if responses[1].Header.Get(dedupeHeader) != "true" {
+		t.Errorf("second response lacks %s", dedupeHeader)
+	}
+	for i, origin := range origins {
+		if got := responses[i].Header.Get("Access-Control-Allow-Origin"); got != origin {
+			t.Errorf("response %d: Access-Control-Allow-Origin = %q, want %q", i, got, origin)
+		}
+	}
+}
+
+func TestDedupeSkipsStreams(t *testing.T) {
+	upstream := newFakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: [DONE]\n\n"))
+	})
+	cfg := testConfig()
+	cfg.DedupeRequests = true
+	adapter := startAdapter(t, cfg, upstream)
+
+	body := `{"model":"gpt-oss:20b","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	post(t, adapter, "/v1/chat/completions", body)
+	post(t, adapter, "/v1/chat/completions", body)
+	if n := len(upstream.received()); n != 2 {
+		t.Errorf("upstream received %d streamed requests, want 2", n)
+	}
+}
+
+// Requests outside of --inject-paths are never merged, two concurrent
+// /api/create calls both reach Ollama
+func TestDedupeSkipsOtherEndpoints(t *testing.T) {
+	release := make(chan struct{})
+	upstream := newFakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success"}`))
+	})
+	cfg := testConfig()
+	cfg.DedupeRequests = true
+	adapter := startAdapter(t, cfg, upstream)
+
+	body := `{"model":"gpt-oss:custom","from":"gpt-oss:20b","stream":false}`
+	// Waiting for both calls fails the test if the second one was merged, the
+	// first is only released afterwards
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(release)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Post(adapter.URL+"/api/create", "application/json", bytes.NewBufferString(body))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.Header.Get(dedupeHeader) != "" {
+				t.Errorf("/api/create response carries %s", dedupeHeader)
+			}
+		}()
+	}
+	waitFor(t, func() bool { return len(upstream.received()) == 2 })
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// APIError is the body of an OpenAI style error response
+type APIError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code,omitempty"`
+}
+
+// APIErrorResponse wraps an APIError in the "error" envelope clients expect
+type APIErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// apiErrorType maps a status code to the OpenAI error type
+func apiErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= 400 && status < 500:
+		return "invalid_request_error"
+	default:
+		return "server_error"
+	}
+}
+
+// writeAPIError answers with an OpenAI style JSON error so clients like Cline
+// can show the message instead of a raw response body
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(APIErrorResponse{Error: APIError{
+		Message: message,
+		Type:    apiErrorType(status),
+		Code:    code,
+	}})
+}
+
+// ollamaError is the flat error body returned by Ollama, e.g. {"error":"model 'x' not found"}
+type ollamaError struct {
+	Error string `json:"error"`
+}
+
+// ollamaErrorCode infers an OpenAI error code from an Ollama error message
+func ollamaErrorCode(status int, message string) string {
+	lower := strings.ToLower(message)
+	switch {
+	case strings.Contains(lower, "model") && strings.Contains(lower, "not found"):
+		return "model_not_found"
+	case strings.Contains(lower, "context length") || strings.Contains(lower, "context window"):
+		return "context_length_exceeded"
+	case status == http.StatusNotFound:
+		return "not_found"
+	case status == http.StatusBadRequest:
+		return "invalid_request"
+	default:
+		return "upstream_error"
+	}
+}
+
+// rewriteUpstreamError rewraps Ollama's flat error responses into the OpenAI
+// error envelope. Errors already in the OpenAI shape, or bodies that aren't
+// JSON, are left alone.
+func rewriteUpstreamError(resp *http.Response) error {
+	if resp.StatusCode < 400 ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	if ok, err := decodeResponseBody(resp); !ok || err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading upstream response: %v", err)
+	}
+	resp.Body.Close()
+	resp.Body = &nopCloser{reader: bytes.NewReader(body)}
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+
+	var flat ollamaError
+	if err := json.Unmarshal(body, &flat); err != nil || flat.Error == "" {
+		return nil
+	}
+	newBody, err := json.Marshal(APIErrorResponse{Error: APIError{
+		Message: flat.Error,
+		Type:    apiErrorType(resp.StatusCode),
+		Code:    ollamaErrorCode(resp.StatusCode, flat.Error),
+	}})
+	if err != nil {
+		return nil
+	}
+	resp.Body = &nopCloser{reader: bytes.NewReader(newBody)}
+	resp.ContentLength = int64(len(newBody))
+	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(newBody)))
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRewriteUpstreamError(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		want        *APIError // nil when the body must be left as sent
+	}{
+		{
+			name:        "model not found",
+			status:      http.StatusNotFound,
+			contentType: "application/json; charset=utf-8",
+			body:        `{"error":"model 'gpt-oss:200b' not found"}`,
+			want:        &APIError{Message: "model 'gpt-oss:200b' not found", Type: "invalid_request_error", Code: "model_not_found"},
+		},
+		{
+			name:        "model not found, pull hint",
+			status:      http.StatusNotFound,
+			contentType: "application/json; charset=utf-8",
+			body:        `{"error":"model \"gpt-oss:200b\" not found, try pulling it first"}`,
+			want:        &APIError{Message: `model "gpt-oss:200b" not found, try pulling it first`, Type: "invalid_request_error", Code: "model_not_found"},
+		},
+		{
+			name:        "server error",
+			status:      http.StatusInternalServerError,
+			contentType: "application/json; charset=utf-8",
+			body:        `{"error":"llama runner process has terminated: exit status 2"}`,
+			want:        &APIError{Message: "llama runner process has terminated: exit status 2", Type: "server_error", Code: "upstream_error"},
+		},
+		{
+			name:        "already in the OpenAI shape",
+			status:      http.StatusNotFound,
+			contentType: "application/json",
+			body:        `{"error":{"message":"model \"x\" not found, try pulling it first","type":"api_error","param":null,"code":null}}`,
+		},
+		{
+			name:        "not JSON",
+			status:      http.StatusBadGateway,
+			contentType: "text/plain",
+			body:        `{"error":"bad gateway"}`,
+		},
+		{
+			name:        "success",
+			status:      http.StatusOK,
+			contentType: "application/json",
+			body:        `{"error":"not an error"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: tt.status,
+				Header:     http.Header{"Content-Type": {tt.contentType}},
+				Body:       ioutil.NopCloser(strings.NewReader(tt.body)),
+			}
+			if err := rewriteUpstreamError(resp); err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == nil {
+				if string(body) != tt.body {
+					t.Errorf("body = %s, want it as sent: %s", body, tt.body)
+				}
+				return
+			}
+			var got APIErrorResponse
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("invalid body %s: %v", body, err)
+			}
+			if got.Error != *tt.want {
+				t.Errorf("error = %+v, want %+v", got.Error, *tt.want)
+			}
+			if cl := resp.Header.Get("Content-Length"); cl != strconv.Itoa(len(body)) {
+				t.Errorf("Content-Length = %s, want %d", cl, len(body))
+			}
+		})
+	}
+}
+
+func TestModelNotFoundRewrappedEndToEnd(t *testing.T) {
+	upstream := newFakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"model 'gpt-oss:200b' not found"}`))
+	})
+	adapter := startAdapter(t, testConfig(), upstream)
+
+	resp, body := post(t, adapter, "/v1/chat/completions", `{"model":"gpt-oss:200b","messages":[{"role":"user","content":"hi"}]}`)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %s, want the upstream's 404", resp.Status)
+	}
+	var got APIErrorResponse
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("invalid body %s: %v", body, err)
+	}
+	if got.Error.Code != "model_not_found" || got.Error.Message != "model 'gpt-oss:200b' not found" {
+		t.Errorf("error = %+v, want model_not_found with Ollama's message", got.Error)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// grammarFallbackHeader marks responses produced by the retry without the grammar
+const grammarFallbackHeader = "X-Adapter-Grammar-Fallback"
+
+// fallbackTransport retries a non-streaming request once without the injected
+// grammar when the upstream fails in a way the grammar can cause: an error
+// mentioning the grammar, or a completion without any content or tool calls.
+// Requests are only retried when the handler stored their body without the
+// grammar in the request context.
+type fallbackTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *fallbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fallback, ok := req.Context().Value(fallbackBodyContextKey).([]byte)
+	if !ok || isStreamRequest(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	failed, err := isGrammarFailure(resp)
+	if err != nil || !failed {
+		return resp, err
+	}
+	resp.Body.Close()
+	requestLogger(req.Context()).Warn("retrying upstream request without grammar",
+		"method", req.Method,
+		"path", req.URL.Path,
+		"status", resp.StatusCode)
+
+	retry := req.Clone(req.Context())
+	retry.Body = ioutil.NopCloser(bytes.NewReader(fallback))
+	retry.ContentLength = int64(len(fallback))
+	retry.Header.Set("Content-Length", fmt.Sprintf("%d", len(fallback)))
+	resp, err = t.next.RoundTrip(retry)
+	if err == nil {
+		resp.Header.Set(grammarFallbackHeader, "true")
+	}
+	return resp, err
+}
+
+// isGrammarFailure reports whether a response looks like the grammar made the
+// request fail. The body is read and put back for the caller. Compressed
+// bodies are never considered failures.
+func isGrammarFailure(resp *http.Response) (bool, error) {
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return false, fmt.Errorf("reading upstream response: %v", err)
+	}
+	resp.Body = &nopCloser{reader: bytes.NewReader(body)}
+
+	if resp.StatusCode >= 400 {
+		return bytes.Contains(bytes.ToLower(body), []byte("grammar")), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, nil
+	}
+	if isOllamaNativeChat(resp.Request.URL.Path) {
+		var native struct {
+			Message OllamaMessage `json:"message"`
+		}
+		if err := json.Unmarshal(body, &native); err != nil {
+			return false, nil
+		}
+		return strings.TrimSpace(native.Message.Content) == "" && len(native.Message.ToolCalls) == 0, nil
+	}
+	var completion ChatCompletionResponse
+	if err := json.Unmarshal(body, &completion); err != nil || len(completion.Choices) == 0 {
+		return false, nil
+	}
+	for _, choice := range completion.Choices {
+		if strings.TrimSpace(choice.Message.Content) != "" || len(choice.Message.ToolCalls) > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// The retry without the grammar keeps the other request transforms: the
+// reasoning removed by --strip-thinking stays removed
+func TestFallbackKeepsOtherTransforms(t *testing.T) {
+	var upstream *fakeOllama
+	upstream = newFakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if len(upstream.received()) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"failed to parse grammar"}`))
+			return
+		}
+		w.Write([]byte(fakeCompletion))
+	})
+	cfg := testConfig()
+	cfg.FallbackNoGrammar = true
+	cfg.StripThinking = true
+	adapter := startAdapter(t, cfg, upstream)
+
+	body := `{"model":"gpt-oss:20b","messages":[` +
+		`{"role":"user","content":"a"},` +
+		`{"role":"assistant","content":"b","reasoning_content":"r"},` +
+		`{"role":"user","content":"c"}]}`
+	resp, _ := post(t, adapter, "/v1/chat/completions", body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %s", resp.Status)
+	}
+	if resp.Header.Get(grammarFallbackHeader) != "true" {
+		t.Errorf("response lacks %s", grammarFallbackHeader)
+	}
+
+	requests := upstream.received()
+	if len(requests) != 2 {
+		t.Fatalf("upstream received %d requests, want 2", len(requests))
+	}
+	if _, ok := forwardedGrammar(t, requests[0].Body); !ok {
+		t.Errorf("first request has no grammar:\n%s", requests[0].Body)
+	}
+	retry := requests[1].Body
+	if _, ok := forwardedGrammar(t, retry); ok {
+		t.Errorf("retry still has the grammar:\n%s", retry)
+	}
+	if strings.Contains(string(retry), "reasoning_content") {
+		t.Errorf("retry lost --strip-thinking:\n%s", retry)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+)
+
+// defaultGrammar is used when no valid grammar file is available. It is the
+// cline.gbnf shipped with the adapter, embedded at build time so it never drifts.
+//
+//go:embed cline.gbnf
+var defaultGrammar string
+
+// grammarMap maps model name patterns to grammar file paths (loaded once at startup)
+var grammarMap map[string]string
+
+// disabledModels are the --disable-for-models patterns (split once at startup)
+var disabledModels []string
+
+// Grammar sources other than a grammar file path
+const (
+	sourceToolChoice = "tool_choice"
+	sourceGenerated  = "generated"
+	sourceEmbedded   = "embedded"
+	sourceInline     = "inline"
+)
+
+// grammarSourceHeader names the source of the injected grammar in responses,
+// with --expose-grammar-header
+const grammarSourceHeader = "X-Adapter-Grammar-Source"
+
+// grammarSelection describes the grammar chosen for a request
+type grammarSelection struct {
+	Grammar string
+	Source  string // grammar file path or one of the source constants
+	Pattern string // grammar map pattern that matched the model, if any
+}
+
+// selectGrammar picks the grammar for a request: a tool_choice specific grammar,
+// a grammar generated from the tools (with --generate-grammar), or the model's grammar file
+func selectGrammar(req *ChatCompletionRequest) grammarSelection {
+	if grammar := grammarForToolChoice(req.ToolChoice, req.Tools); grammar != "" {
+		return grammarSelection{Grammar: grammar, Source: sourceToolChoice}
+	}
+	if config.GenerateGrammar && len(req.Tools) > 0 {
+		grammar, err := buildGrammarFromTools(req.Tools)
+		if err == nil {
+			return grammarSelection{Grammar: grammar, Source: sourceGenerated}
+		}
+		slog.Warn("could not generate grammar from tools, using static grammar", "error", err)
+	}
+	return loadGrammar(req.Model, len(req.Tools) > 0)
+}
+
+// loadGrammar returns the Cline grammar for the given model from the in-memory
+// cache: the model's grammar map entry, else the --tool-grammar or
+// --chat-grammar file depending on whether the request has tools, else the
+// default grammar file
+func loadGrammar(model string, tools bool) grammarSelection {
+	grammarPath := config.GrammarFile
+	if tools && config.ToolGrammar != "" {
+		grammarPath = config.ToolGrammar
+	} else if !tools && config.ChatGrammar != "" {
+		grammarPath = config.ChatGrammar
+	}
+	pattern, mapped := grammarPathForModel(model)
+	if mapped != "" {
+		grammarPath = mapped
+	}
+
+	// The cache logs read failures, once
+	grammar, err := grammars.get(grammarPath)
+	if err != nil {
+		return grammarSelection{Grammar: defaultGrammar, Source: sourceEmbedded, Pattern: pattern}
+	}
+	return grammarSelection{Grammar: grammar, Source: grammarPath, Pattern: pattern}
+}
+
+// loadGrammarMap reads a JSON object mapping model name patterns to grammar file paths
+func loadGrammarMap(mapPath string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(mapPath)
+	if err != nil {
+		return nil, err
+	}
+	mapping := make(map[string]string)
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", mapPath, err)
+	}
+	for pattern, grammarPath := range mapping {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid model pattern %q: %v", pattern, err)
+		}
+		mapping[pattern] = expandPath(grammarPath)
+	}
+	return mapping, nil
+}
+
+// matchModelPattern reports whether the model name matches the pattern.
+// Patterns are either exact names or globs such as "gpt-oss:*".
+func matchModelPattern(pattern, model string) bool {
+	if pattern == model {
+		return true
+	}
+	matched, err := path.Match(pattern, model)
+	return err == nil && matched
+}
+
+// disabledModelPattern reports whether grammar injection is disabled for a model
+// by --disable-for-models and returns the pattern that matched
+func disabledModelPattern(model string) (string, bool) {
+	if model == "" {
+		return "", false
+	}
+	for _, pattern := range disabledModels {
+		if matchModelPattern(pattern, model) {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// grammarPathForModel looks up the grammar file for a model in the grammar map
+// and returns the matching pattern along with the path, or empty strings.
+// Exact names win over patterns, and longer patterns win over shorter ones.
+func grammarPathForModel(model string) (pattern, grammarPath string) {
+	if model == "" || len(grammarMap) == 0 {
+		return "", ""
+	}
+	if grammarPath, ok := grammarMap[model]; ok {
+		return model, grammarPath
+	}
+
+	patterns := make([]string, 0, len(grammarMap))
+	for pattern := range grammarMap {
+		patterns = append(patterns, pattern)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	for _, pattern := range patterns {
+		if matchModelPattern(pattern, model) {
+			return pattern, grammarMap[pattern]
+		}
+	}
+	return "", ""
+}
+
+// isJSONSchemaGrammar reports whether a grammar file holds a JSON schema
+// instead of GBNF rules
+func isJSONSchemaGrammar(grammar string) bool {
+	var schema map[string]interface{}
+	return strings.HasPrefix(strings.TrimSpace(grammar), "{") && json.Unmarshal([]byte(grammar), &schema) == nil
+}
+
+// validateGrammar does structural checks on a GBNF grammar: every rule has a
+// name and a body, a root rule is present, strings, character classes and
+// parentheses are terminated, and every referenced rule is defined.
+func validateGrammar(grammar string) error {
+	if isJSONSchemaGrammar(grammar) {
+		// JSON schemas are passed to Ollama's format field as they are
+		return nil
+	}
+	defined := make(map[string]bool)
+	var references []string
+	var current string
+	var depth int
+	var bodyEmpty bool
+
+	endRule := func() error {
+		if current == "" {
+			return nil
+		}
+		if depth != 0 {
+			return fmt.Errorf("rule %q has unbalanced parentheses", current)
+		}
+		if bodyEmpty {
+			return fmt.Errorf("rule %q has an empty body", current)
+		}
+		return nil
+	}
+
+	for i := 0; i < len(grammar); {
+		c := grammar[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '#':
+			for i < len(grammar) && grammar[i] != '\n' {
+				i++
+			}
+		case c == '"' || c == '[':
+			end, err := scanGrammarLiteral(grammar, i)
+			if err != nil {
+				return err
+			}
+			i = end
+			bodyEmpty = false
+		case c == '(':
+			depth++
+			i++
+			bodyEmpty = false
+		case c == ')':
+			if depth == 0 {
+				return fmt.Errorf("unexpected ')' in rule %q", current)
+			}
+			depth--
+			i++
+		case c == '.':
+			i++
+			bodyEmpty = false
+		case c == '|' || c == '*' || c == '+' || c == '?':
+			i++
+		case c == '{':
+			end := strings.IndexByte(grammar[i:], '}')
+			if end < 0 {
+				return fmt.Errorf("unterminated repetition in rule %q", current)
+			}
+			i += end + 1
+		case isGrammarNameChar(c):
+			start := i
+			for i < len(grammar) && isGrammarNameChar(grammar[i]) {
+				i++
+			}
+			name := grammar[start:i]
+
+			// A name followed by ::= starts a new rule
+			j := i
+			for j < len(grammar) && (grammar[j] == ' ' || grammar[j] == '\t') {
+				j++
+			}
+			if strings.HasPrefix(grammar[j:], "::=") {
+				if err := endRule(); err != nil {
+					return err
+				}
+				current, depth, bodyEmpty = name, 0, true
+				defined[name] = true
+				i = j + 3
+				continue
+			}
+			if current == "" {
+				return fmt.Errorf("unexpected %q before the first rule", name)
+			}
+			references = append(references, name)
+			bodyEmpty = false
+		case strings.HasPrefix(grammar[i:], "::="):
+			return fmt.Errorf("rule definition without a name")
+		default:
+			return fmt.Errorf("unexpected character %q in rule %q", c, current)
+		}
+	}
+	if err := endRule(); err != nil {
+		return err
+	}
+
+	if !defined["root"] {
+		return fmt.Errorf("no root rule defined")
+	}
+	for _, name := range references {
+		if !defined[name] {
+			return fmt.Errorf("reference to undefined rule %q", name)
+		}
+	}
+	return nil
+}
+
+// scanGrammarLiteral returns the index just past the string or character
+// class starting at grammar[start]
+func scanGrammarLiteral(grammar string, start int) (int, error) {
+	closing := byte('"')
+	kind := "string"
+	if grammar[start] == '[' {
+		closing = ']'
+		kind = "character class"
+	}
+	for i := start + 1; i < len(grammar); i++ {
+		switch grammar[i] {
+		case '\\':
+			i++
+		case '\n':
+			return 0, fmt.Errorf("unterminated %s at offset %d", kind, start)
+		case closing:
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated %s at offset %d", kind, start)
+}
+
+// isGrammarNameChar reports whether c may appear in a GBNF rule name
+func isGrammarNameChar(c byte) bool {
+	return c == '-' || c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// grammarEntry is a grammar file held in memory. When the file can no longer
+// be read, err is set and content keeps the last good grammar, empty if the
+// file was never read.
+type grammarEntry struct {
+	content string
+	target  string // the file read after resolving symlinks
+	modTime time.Time
+	size    int64
+	err     error
+}
+
+// failed returns a copy of the entry recording a read failure
+func (e *grammarEntry) failed(err error) *grammarEntry {
+	failed := *e
+	failed.err = err
+	return &failed
+}
+
+// grammarCache keeps grammar files in memory, keyed by path. Reads happen on
+// the request path, reloads from the watcher goroutine.
+type grammarCache struct {
+	mu      sync.RWMutex
+	entries map[string]*grammarEntry
+}
+
+// grammars is the cache loadGrammar reads from
+var grammars = &grammarCache{entries: make(map[string]*grammarEntry)}
+
+// get returns the cached grammar for a path, reading the file on first use.
+// A file that can't be read is remembered as missing and not tried again
+// on the request path, the watcher picks it up once it can be read.
+func (c *grammarCache) get(grammarPath string) (string, error) {
+	c.mu.RLock()
+	entry, ok := c.entries[grammarPath]
+	c.mu.RUnlock()
+	if ok && entry.content != "" {
+		return entry.content, nil
+	}
+	if ok {
+		return "", entry.err
+	}
+
+	loaded, err := loadGrammarEntry(grammarPath)
+	if err != nil {
+		slog.Warn("could not load grammar file, using embedded grammar", "path", grammarPath, "error", err)
+		c.set(grammarPath, &grammarEntry{err: err})
+		return "", err
+	}
+	c.set(grammarPath, loaded)
+	return loaded.content, nil
+}
+
+// set stores a grammar in the cache
+func (c *grammarCache) set(grammarPath string, entry *grammarEntry) {
+	c.mu.Lock()
+	c.entries[grammarPath] = entry
+	c.mu.Unlock()
+}
+
+// reload re-reads every cached grammar whose file changed since it was loaded.
+// The previous grammar is kept when the file cannot be read, which is logged
+// once until the file can be read again.
+func (c *grammarCache) reload() {
+	c.mu.RLock()
+	paths := make(map[string]*grammarEntry, len(c.entries))
+	for grammarPath, entry := range c.entries {
+		paths[grammarPath] = entry
+	}
+	c.mu.RUnlock()
+
+	for grammarPath, old := range paths {
+		// Kubernetes updates mounted ConfigMaps by swapping the ..data symlink
+		// to a new directory, which a changed target reveals even when the
+		// new file has the same size and modification time
+		target, err := filepath.EvalSymlinks(grammarPath)
+		var info os.FileInfo
+		if err == nil {
+			info, err = os.Stat(target)
+		}
+		if err == nil && old.err == nil && target == old.target &&
+			info.ModTime().Equal(old.modTime) && info.Size() == old.size {
+			continue
+		}
+
+		var entry *grammarEntry
+		if err == nil {
+			entry, err = loadGrammarEntry(grammarPath)
+		}
+		if err != nil {
+			if old.err == nil {
+				slog.Error("grammar reload failed, keeping previous grammar", "path", grammarPath, "error", err)
+			}
+			c.set(grammarPath, old.failed(err))
+			continue
+		}
+		c.set(grammarPath, entry)
+		slog.Info("grammar reloaded", "path", grammarPath, "bytes", len(entry.content))
+	}
+}
+
+// watch polls the cached grammar files for changes until stop is closed
+func (c *grammarCache) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.reload()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// loadGrammarEntry reads a grammar file and rejects it if it is not a valid grammar
+func loadGrammarEntry(grammarPath string) (*grammarEntry, error) {
+	entry, err := readGrammarEntry(grammarPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateGrammar(entry.content); err != nil {
+		return nil, fmt.Errorf("invalid grammar %s: %v", grammarPath, err)
+	}
+	return entry, nil
+}
+
+// readGrammarEntry reads a grammar file along with its modification time.
+// Symlinks are resolved first and the file is read and stat'ed through one
+// open descriptor, so a symlink swapped meanwhile can't pair the content of
+// one file with the modification time of another.
+func readGrammarEntry(grammarPath string) (*grammarEntry, error) {
+	target, err := filepath.EvalSymlinks(grammarPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(target)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return &grammarEntry{content: string(data), target: target, modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// preloadGrammars reads and validates the default grammar, the tool and chat
+// grammars and every mapped grammar into the cache. Invalid grammars are replaced by the embedded one,
+// or reported as an error with --strict-grammar.
+func preloadGrammars() error {
+	paths := []string{config.GrammarFile}
+	for _, grammarPath := range []string{config.ToolGrammar, config.ChatGrammar} {
+		if grammarPath != "" {
+			paths = append(paths, grammarPath)
+		}
+	}
+	for _, grammarPath := range grammarMap {
+		paths = append(paths, grammarPath)
+	}
+	for _, grammarPath := range paths {
+		entry, err := readGrammarEntry(grammarPath)
+		if err != nil {
+			slog.Warn("could not load grammar file, using embedded grammar", "path", grammarPath, "error", err)
+			grammars.set(grammarPath, &grammarEntry{err: err})
+			continue
+		}
+		if err := validateGrammar(entry.content); err != nil {
+			if config.StrictGrammar {
+				return fmt.Errorf("invalid grammar %s: %v", grammarPath, err)
+			}
+			slog.Warn("invalid grammar file, using embedded grammar", "path", grammarPath, "error", err)
+			// Recorded as a failure, so loadGrammar reports the embedded grammar as the source
+			grammars.set(grammarPath, &grammarEntry{err: fmt.Errorf("invalid grammar %s: %v", grammarPath, err)})
+			continue
+		}
+		grammars.set(grammarPath, entry)
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useGrammarCache gives the test an empty grammar cache
+func useGrammarCache(t testing.TB) {
+	t.Helper()
+	saved := grammars
+	grammars = &grammarCache{entries: make(map[string]*grammarEntry)}
+	t.Cleanup(func() { grammars = saved })
+}
+
+// writeGrammar writes a grammar file into dir and returns its path
+func writeGrammar(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPreloadGrammarsInvalidFallsBackToEmbedded(t *testing.T) {
+	useGrammarCache(t)
+	dir := t.TempDir()
+	cfg := testConfig()
+	cfg.GrammarFile = writeGrammar(t, dir, "bad.gbnf", "this is not a grammar")
+	cfg.ToolGrammar = writeGrammar(t, dir, "tools.gbnf", `root ::= "x"`)
+	useConfig(t, cfg)
+
+	if err := preloadGrammars(); err != nil {
+		t.Fatal(err)
+	}
+	chat := loadGrammar("gpt-oss:20b", false)
+	if chat.Source != sourceEmbedded || chat.Grammar != defaultGrammar {
+		t.Errorf("invalid grammar: source = %q, want %q with the embedded grammar", chat.Source, sourceEmbedded)
+	}
+	tools := loadGrammar("gpt-oss:20b", true)
+	if tools.Source != cfg.ToolGrammar || tools.Grammar != `root ::= "x"` {
+		t.Errorf("valid grammar: source = %q, grammar = %q", tools.Source, tools.Grammar)
+	}
+}
+
+func TestPreloadGrammarsStrict(t *testing.T) {
+	useGrammarCache(t)
+	cfg := testConfig()
+	cfg.GrammarFile = writeGrammar(t, t.TempDir(), "bad.gbnf", "this is not a grammar")
+	cfg.StrictGrammar = true
+	useConfig(t, cfg)
+
+	if err := preloadGrammars(); err == nil {
+		t.Error("preloadGrammars accepted an invalid grammar with --strict-grammar")
+	}
+}
+
+func TestGrammarCacheRemembersMissingFile(t *testing.T) {
+	useGrammarCache(t)
+	path := filepath.Join(t.TempDir(), "late.gbnf")
+
+	if _, err := grammars.get(path); err == nil {
+		t.Fatal("get succeeded for a missing file")
+	}
+	writeGrammar(t, filepath.Dir(path), "late.gbnf", `root ::= "x"`)
+	if _, err := grammars.get(path); err == nil {
+		t.Error("get went back to disk for a file it knew was missing")
+	}
+
+	// The watcher picks the file up
+	grammars.reload()
+	if got, err := grammars.get(path); err != nil || got != `root ::= "x"` {
+		t.Errorf("after reload: get = %q, %v", got, err)
+	}
+}
+
+// BenchmarkLoadGrammar measures the grammar lookup of every request, served
+// from the cache
+func BenchmarkLoadGrammar(b *testing.B) {
+	useGrammarCache(b)
+	useConfig(b, testConfig())
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		loadGrammar("gpt-oss:20b", true)
+	}
+}
+
+// BenchmarkReadGrammarFile measures reading the grammar file on every
+// request, which the cache replaced
+func BenchmarkReadGrammarFile(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := os.ReadFile("cline.gbnf"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkLoadGrammarMissing measures the lookup of a missing grammar file,
+// which falls back to the embedded grammar without going back to disk
+func BenchmarkLoadGrammarMissing(b *testing.B) {
+	useGrammarCache(b)
+	cfg := testConfig()
+	cfg.GrammarFile = filepath.Join(b.TempDir(), "missing.gbnf")
+	useConfig(b, cfg)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		loadGrammar("gpt-oss:20b", true)
+	}
+}
+
+// captureLogs sends the default logger to a buffer for the rest of the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+	return &buf
+}
+
+func TestGrammarCacheKeepsLastGoodGrammar(t *testing.T) {
+	useGrammarCache(t)
+	cfg := testConfig()
+	cfg.GrammarFile = writeGrammar(t, t.TempDir(), "cline.gbnf", `root ::= "good"`)
+	useConfig(t, cfg)
+	if err := preloadGrammars(); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := captureLogs(t)
+	if err := os.Remove(cfg.GrammarFile); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		grammars.reload()
+		got := loadGrammar("gpt-oss:20b", false)
+		if got.Grammar != `root ::= "good"` || got.Source != cfg.GrammarFile {
+			t.Fatalf("reload %d: grammar = %q from %q, want the last good grammar from the file", i, got.Grammar, got.Source)
+		}
+	}
+	if n := strings.Count(logs.String(), "grammar reload failed"); n != 1 {
+		t.Errorf("read failure logged %d times, want once:\n%s", n, logs)
+	}
+
+	// Once the file is back it is read again, and a new failure logged again
+	writeGrammar(t, filepath.Dir(cfg.GrammarFile), "cline.gbnf", `root ::= "new"`)
+	grammars.reload()
+	if got := loadGrammar("gpt-oss:20b", false); got.Grammar != `root ::= "new"` {
+		t.Errorf("after restoring the file: grammar = %q", got.Grammar)
+	}
+	os.Remove(cfg.GrammarFile)
+	grammars.reload()
+	if n := strings.Count(logs.String(), "grammar reload failed"); n != 2 {
+		t.Errorf("second removal: read failure logged %d times in total, want 2", n)
+	}
+}
+
+func TestGrammarCacheConfigMapSwap(t *testing.T) {
+	useGrammarCache(t)
+	// The layout of a mounted ConfigMap: the file links through ..data to a
+	// timestamped directory holding the real file
+	dir := t.TempDir()
+	mtime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	version := func(name, content string) {
+		t.Helper()
+		if err := os.Mkdir(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		path := writeGrammar(t, filepath.Join(dir, name), "cline.gbnf", content)
+		// Same size and modification time, only the symlink target tells the versions apart
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// swapData points ..data at a version the way the kubelet does, by
+	// renaming a new symlink over it
+	swapData := func(name string) {
+		t.Helper()
+		tmp := filepath.Join(dir, "..data_tmp")
+		if err := os.Symlink(name, tmp); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	version("..2026_01_02_03_04_05.1", `root ::= "one"`)
+	swapData("..2026_01_02_03_04_05.1")
+	path := filepath.Join(dir, "cline.gbnf")
+	if err := os.Symlink(filepath.Join("..data", "cline.gbnf"), path); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := grammars.get(path); err != nil || got != `root ::= "one"` {
+		t.Fatalf("get = %q, %v", got, err)
+	}
+	version("..2026_01_02_03_04_05.2", `root ::= "two"`)
+	swapData("..2026_01_02_03_04_05.2")
+	os.RemoveAll(filepath.Join(dir, "..2026_01_02_03_04_05.1"))
+
+	grammars.reload()
+	if got, err := grammars.get(path); err != nil || got != `root ::= "two"` {
+		t.Errorf("after the swap: get = %q, %v, want the new version", got, err)
+	}
+}
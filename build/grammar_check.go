@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// grammarTestResult is the report printed by --test-grammar
+type grammarTestResult struct {
+	Result       string      `json:"result"` // pass or fail
+	Grammar      string      `json:"grammar"`
+	Sample       string      `json:"sample"`
+	Error        string      `json:"error,omitempty"`
+	Message      ChatMessage `json:"message"`
+	FinishReason *string     `json:"finish_reason,omitempty"`
+}
+
+// runGrammarTest checks a sample of model output against a grammar file and
+// prints whether the grammar accepts it, along with the message the adapter
+// would make of it. It returns the process exit code: 0 when the sample is
+// accepted, 1 when it is rejected and 2 when either file can't be used.
+func runGrammarTest(grammarPath, samplePath string) int {
+	entry, err := loadGrammarEntry(grammarPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	if isJSONSchemaGrammar(entry.content) {
+		fmt.Fprintf(os.Stderr, "Error: %s holds a JSON schema, only GBNF grammars can be tested\n", grammarPath)
+		return 2
+	}
+	rules, err := parseGBNF(entry.content)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid grammar %s: %v\n", grammarPath, err)
+		return 2
+	}
+	data, err := os.ReadFile(samplePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	// Editors end files with a newline the model never sent
+	sample := strings.TrimSuffix(string(data), "\n")
+
+	result := grammarTestResult{Result: "pass", Grammar: grammarPath, Sample: samplePath}
+	if ok, offset := matchGrammar(rules, sample); !ok {
+		result.Result = "fail"
+		result.Error = fmt.Sprintf("output rejected at %s", describeOffset(sample, offset))
+	}
+
+	msg := ChatMessage{Role: "assistant"}
+	msg.ReasoningContent = parseHarmonyReasoning(sample)
+	msg.Content, msg.ToolCalls = parseHarmonyResponse(sample, "")
+	result.Message = msg
+	result.FinishReason = harmonyFinishReason(nil, &msg)
+
+	out, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(out))
+	if result.Result != "pass" {
+		return 1
+	}
+	return 0
+}
+
+// describeOffset turns a character offset into a line and column, quoting the
+// text found there
+func describeOffset(text string, offset int) string {
+	runes := []rune(text)
+	line, column := 1, 1
+	for _, r := range runes[:offset] {
+		if r == '\n' {
+			line, column = line+1, 1
+		} else {
+			column++
+		}
+	}
+	if offset >= len(runes) {
+		return fmt.Sprintf("line %d, column %d (end of output)", line, column)
+	}
+	end := offset + 20
+	if end > len(runes) {
+		end = len(runes)
+	}
+	return fmt.Sprintf("line %d, column %d, near %q", line, column, string(runes[offset:end]))
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// toolCallGrammarTemplate forces the model to answer with a single tool call.
+// The %s placeholder is replaced by the rule for the allowed function names.
+const toolCallGrammarTemplate = `root ::= analysis? start toolcall
+analysis ::= "<|channel|>analysis<|message|>" ( [^<] | "<" [^|] | "<|" [^e] )* "<|end|>"
+start ::= "<|start|>assistant"
+toolcall ::= "<|channel|>commentary to=functions." name " <|constrain|>json<|message|>" .+
+name ::= %s`
+
+// grammarForToolChoice returns a grammar that enforces the request's tool_choice.
+// "required" forces a call to one of the declared tools, an object such as
+// {"type":"function","function":{"name":"X"}} forces a call to X. It returns an
+// empty string for "auto", "none" or no tool_choice, leaving the default grammar in place.
+func grammarForToolChoice(choice interface{}, tools []Tool) string {
+	switch c := choice.(type) {
+	case string:
+		if c != "required" {
+			return ""
+		}
+		var names []string
+		for _, tool := range tools {
+			if tool.Function.Name != "" {
+				names = append(names, tool.Function.Name)
+			}
+		}
+		if len(names) == 0 {
+			return fmt.Sprintf(toolCallGrammarTemplate, "[a-zA-Z0-9_.-]+")
+		}
+		return fmt.Sprintf(toolCallGrammarTemplate, gbnfAlternatives(names))
+	case map[string]interface{}:
+		function, _ := c["function"].(map[string]interface{})
+		name, _ := function["name"].(string)
+		if name == "" {
+			return ""
+		}
+		return fmt.Sprintf(toolCallGrammarTemplate, gbnfString(name))
+	}
+	return ""
+}
+
+// gbnfAlternatives builds a GBNF alternation of string literals
+func gbnfAlternatives(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = gbnfString(v)
+	}
+	return strings.Join(quoted, " | ")
+}
+
+// gbnfString quotes a value as a GBNF string literal
+func gbnfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// jsonGrammarRules are the JSON primitives shared by generated grammars
+const jsonGrammarRules = `ws ::= [ \t\n]*
+string ::= "\"" ( [^"\\] | "\\" ( ["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] ) )* "\""
+number ::= "-"? ( "0" | [1-9] [0-9]* ) ( "." [0-9]+ )? ( [eE] [-+]? [0-9]+ )?
+integer ::= "-"? ( "0" | [1-9] [0-9]* )
+boolean ::= "true" | "false"
+null ::= "null"
+value ::= object | array | string | number | boolean | null
+object ::= "{" ws ( string ws ":" ws value ( "," ws string ws ":" ws value )* )? ws "}"
+array ::= "[" ws ( value ( "," ws value )* )? ws "]"`
+
+// grammarBuilder accumulates the rules of a generated grammar
+type grammarBuilder struct {
+	rules []string
+	count int
+}
+
+// rule adds a rule with a unique name derived from prefix and returns the name
+func (g *grammarBuilder) rule(prefix, body string) string {
+	name := fmt.Sprintf("%s-%d", prefix, g.count)
+	g.count++
+	g.rules = append(g.rules, name+" ::= "+body)
+	return name
+}
+
+// buildGrammarFromTools generates a grammar that only lets the model answer with
+// final text or a call to one of the given tools. Call arguments are constrained
+// by each tool's JSON schema: declared properties appear in alphabetical order,
+// required ones always and optional ones at most once.
+func buildGrammarFromTools(tools []Tool) (string, error) {
+	if len(tools) == 0 {
+		return "", fmt.Errorf("no tools")
+	}
+
+	g := &grammarBuilder{}
+	var calls []string
+	for _, tool := range tools {
+		name := tool.Function.Name
+		if name == "" {
+			return "", fmt.Errorf("tool without a function name")
+		}
+		args, err := g.schema("args", tool.Function.Parameters)
+		if err != nil {
+			return "", fmt.Errorf("tool %q: %v", name, err)
+		}
+		calls = append(calls, g.rule("call", gbnfString(name)+` " <|constrain|>json<|message|>" ws `+args+" ws"))
+	}
+
+	grammar := `root ::= analysis? start ( final | call )
+analysis ::= "<|channel|>analysis<|message|>" ( [^<] | "<" [^|] | "<|" [^e] )* "<|end|>"
+start ::= "<|start|>assistant"
+final ::= "<|channel|>final<|message|>" .+
+call ::= "<|channel|>commentary to=functions." ( ` + strings.Join(calls, " | ") + ` )
+` + strings.Join(g.rules, "\n") + "\n" + jsonGrammarRules
+
+	if err := validateGrammar(grammar); err != nil {
+		return "", fmt.Errorf("generated grammar is invalid: %v", err)
+	}
+	return grammar, nil
+}
+
+// schema returns the name of a rule matching values of a JSON schema
+func (g *grammarBuilder) schema(prefix string, schema map[string]interface{}) (string, error) {
+	if len(schema) == 0 {
+		return "value", nil
+	}
+	if _, ok := schema["$ref"]; ok {
+		return "", fmt.Errorf("$ref is not supported")
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok && len(enum) > 0 {
+		literals := make([]string, 0, len(enum))
+		for _, v := range enum {
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				return "", err
+			}
+			literals = append(literals, string(encoded))
+		}
+		return g.rule(prefix, gbnfAlternatives(literals)), nil
+	}
+
+	for _, key := range []string{"anyOf", "oneOf"} {
+		if variants, ok := schema[key].([]interface{}); ok && len(variants) > 0 {
+			var alternatives []string
+			for _, variant := range variants {
+				sub, _ := variant.(map[string]interface{})
+				name, err := g.schema(prefix, sub)
+				if err != nil {
+					return "", err
+				}
+				alternatives = append(alternatives, name)
+			}
+			return g.rule(prefix, strings.Join(alternatives, " | ")), nil
+		}
+	}
+
+	switch schemaType(schema) {
+	case "object":
+		return g.object(prefix, schema)
+	case "array":
+		items, _ := schema["items"].(map[string]interface{})
+		item, err := g.schema(prefix, items)
+		if err != nil {
+			return "", err
+		}
+		return g.rule(prefix, `"[" ws ( `+item+` ( "," ws `+item+` )* )? ws "]"`), nil
+	case "string", "number", "integer", "boolean", "null":
+		return schemaType(schema), nil
+	case "":
+		return "value", nil
+	default:
+		return "", fmt.Errorf("unsupported schema type %q", schemaType(schema))
+	}
+}
+
+// object returns the name of a rule matching a JSON object schema
+func (g *grammarBuilder) object(prefix string, schema map[string]interface{}) (string, error) {
+	properties, _ := schema["properties"].(map[string]interface{})
+	if len(properties) == 0 {
+		return "object", nil
+	}
+
+	required := make(map[string]bool)
+	if list, ok := schema["required"].([]interface{}); ok {
+		for _, v := range list {
+			if name, ok := v.(string); ok {
+				required[name] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Required properties come first, in a fixed order
+	var requiredPairs, optionalPairs []string
+	for _, name := range names {
+		sub, _ := properties[name].(map[string]interface{})
+		valueRule, err := g.schema(prefix, sub)
+		if err != nil {
+			return "", err
+		}
+		key, err := json.Marshal(name)
+		if err != nil {
+			return "", err
+		}
+		pair := gbnfString(string(key)) + ` ws ":" ws ` + valueRule
+		if required[name] {
+			requiredPairs = append(requiredPairs, pair)
+		} else {
+			optionalPairs = append(optionalPairs, pair)
+		}
+	}
+
+	body := strings.Join(requiredPairs, ` "," ws `)
+	if len(optionalPairs) > 0 {
+		if len(requiredPairs) > 0 {
+			// Every optional property may follow, each preceded by a comma
+			for _, pair := range optionalPairs {
+				body += ` ( "," ws ` + pair + ` )?`
+			}
+		} else {
+			body = "( " + g.optionalSequence(prefix, optionalPairs) + " )?"
+		}
+	}
+	return g.rule(prefix, `"{" ws `+body+` ws "}"`), nil
+}
+
+// optionalSequence returns a rule matching any non-empty ordered subset of
+// the pairs, separated by commas
+func (g *grammarBuilder) optionalSequence(prefix string, pairs []string) string {
+	var rest string
+	for i := len(pairs) - 1; i >= 0; i-- {
+		alternative := pairs[i]
+		if rest != "" {
+			alternative = pairs[i] + ` ( "," ws ` + rest + ` )? | ` + rest
+		}
+		rest = g.rule(prefix, alternative)
+	}
+	return rest
+}
+
+// schemaType returns the schema's type, using the first entry of a type list
+func schemaType(schema map[string]interface{}) string {
+	switch t := schema["type"].(type) {
+	case string:
+		return t
+	case []interface{}:
+		for _, v := range t {
+			if name, ok := v.(string); ok && name != "null" {
+				return name
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGrammarForToolChoice(t *testing.T) {
+	tools := []Tool{{Type: "function"}, {Type: "function"}}
+	tools[0].Function.Name = "read_file"
+	tools[1].Function.Name = "write_file"
+
+	const (
+		readCall  = "<|start|>assistant<|channel|>commentary to=functions.read_file <|constrain|>json<|message|>{}"
+		writeCall = "<|start|>assistant<|channel|>commentary to=functions.write_file <|constrain|>json<|message|>{}"
+		otherCall = "<|start|>assistant<|channel|>commentary to=functions.delete_file <|constrain|>json<|message|>{}"
+		final     = "<|start|>assistant<|channel|>final<|message|>Done."
+	)
+	tests := []struct {
+		name    string
+		choice  string // tool_choice as JSON, "" for none
+		tools   []Tool
+		accepts []string
+		rejects []string
+	}{
+		{name: "absent", tools: tools},
+		{name: "auto", choice: `"auto"`, tools: tools},
+		{name: "none", choice: `"none"`, tools: tools},
+		{
+			name:    "required",
+			choice:  `"required"`,
+			tools:   tools,
+			accepts: []string{readCall, writeCall, "<|channel|>analysis<|message|>Read it.<|end|>" + readCall},
+			rejects: []string{otherCall, final},
+		},
+		{
+			name:    "required without tools",
+			choice:  `"required"`,
+			accepts: []string{readCall, otherCall},
+			rejects: []string{final},
+		},
+		{
+			name:    "named function",
+			choice:  `{"type":"function","function":{"name":"write_file"}}`,
+			tools:   tools,
+			accepts: []string{writeCall},
+			rejects: []string{readCall, final},
+		},
+		{name: "object without a name", choice: `{"type":"function"}`, tools: tools},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var choice interface{}
+			if tt.choice != "" {
+				if err := json.Unmarshal([]byte(tt.choice), &choice); err != nil {
+					t.Fatal(err)
+				}
+			}
+			grammar := grammarForToolChoice(choice, tt.tools)
+			if tt.accepts == nil {
+				if grammar != "" {
+					t.Errorf("grammarForToolChoice(%s) = %q, want the default grammar", tt.choice, grammar)
+				}
+				return
+			}
+			if err := validateGrammar(grammar); err != nil {
+				t.Fatalf("invalid grammar %q: %v", grammar, err)
+			}
+			rules, err := parseGBNF(grammar)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, output := range tt.accepts {
+				if ok, _ := matchGrammar(rules, output); !ok {
+					t.Errorf("grammar rejects %q", output)
+				}
+			}
+			for _, output := range tt.rejects {
+				if ok, _ := matchGrammar(rules, output); ok {
+					t.Errorf("grammar accepts %q", output)
+				}
+			}
+		})
+	}
+}
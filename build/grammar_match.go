@@ -0,0 +1,433 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// gbnfKind is the kind of a node of a parsed GBNF grammar
+type gbnfKind int
+
+const (
+	gbnfLiteral gbnfKind = iota // a quoted string
+	gbnfClass                   // a [character class]
+	gbnfAny                     // . matching any character
+	gbnfRef                     // a reference to another rule
+	gbnfSeq                     // a sequence of nodes
+	gbnfAlt                     // alternatives separated by |
+	gbnfRepeat                  // a node followed by ?, *, + or {m,n}
+)
+
+// gbnfNode is a node of a parsed GBNF grammar
+type gbnfNode struct {
+	kind     gbnfKind
+	text     []rune      // gbnfLiteral
+	ranges   []runeRange // gbnfClass
+	negated  bool        // gbnfClass
+	name     string      // gbnfRef
+	children []*gbnfNode // gbnfSeq, gbnfAlt, and the repeated node of gbnfRepeat
+	min, max int         // gbnfRepeat, max is -1 when unbounded
+}
+
+// runeRange is an inclusive range of a character class
+type runeRange struct {
+	lo, hi rune
+}
+
+// gbnfParser parses GBNF rules, the subset llama.cpp accepts: strings,
+// character classes, ., groups, rule references, alternatives and the
+// ?, *, +, {m}, {m,} and {m,n} repetitions
+type gbnfParser struct {
+	src string
+	pos int
+}
+
+// parseGBNF parses a GBNF grammar into its rules, keyed by name
+func parseGBNF(grammar string) (map[string]*gbnfNode, error) {
+	if err := validateGrammar(grammar); err != nil {
+		return nil, err
+	}
+	p := &gbnfParser{src: grammar}
+	rules := make(map[string]*gbnfNode)
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.src) {
+			return rules, nil
+		}
+		name := p.readName()
+		p.skipSpace()
+		if name == "" || !strings.HasPrefix(p.src[p.pos:], "::=") {
+			return nil, fmt.Errorf("expected a rule definition at offset %d", p.pos)
+		}
+		p.pos += 3
+		body, err := p.parseAlt()
+		if err != nil {
+			return nil, err
+		}
+		rules[name] = body
+	}
+}
+
+// skipSpace skips whitespace, newlines and comments
+func (p *gbnfParser) skipSpace() {
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		case '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// readName reads a rule name, returning "" when there is none
+func (p *gbnfParser) readName() string {
+	start := p.pos
+	for p.pos < len(p.src) && isGrammarNameChar(p.src[p.pos]) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// atRuleStart reports whether the parser is at the name of the next rule
+func (p *gbnfParser) atRuleStart() bool {
+	i := p.pos
+	for i < len(p.src) && isGrammarNameChar(p.src[i]) {
+		i++
+	}
+	if i == p.pos {
+		return false
+	}
+	for i < len(p.src) && (p.src[i] == ' ' || p.src[i] == '\t') {
+		i++
+	}
+	return strings.HasPrefix(p.src[i:], "::=")
+}
+
+// parseAlt parses alternatives up to the end of the group or rule
+func (p *gbnfParser) parseAlt() (*gbnfNode, error) {
+	alt := &gbnfNode{kind: gbnfAlt}
+	for {
+		seq, err := p.parseSeq()
+		if err != nil {
+			return nil, err
+		}
+		alt.children = append(alt.children, seq)
+		if p.pos >= len(p.src) || p.src[p.pos] != '|' {
+			return alt, nil
+		}
+		p.pos++
+	}
+}
+
+// parseSeq parses a sequence up to the next |, the end of the group or the next rule
+func (p *gbnfParser) parseSeq() (*gbnfNode, error) {
+	seq := &gbnfNode{kind: gbnfSeq}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.src) || p.src[p.pos] == '|' || p.src[p.pos] == ')' || p.atRuleStart() {
+			return seq, nil
+		}
+		node, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if node, err = p.parseRepeat(node); err != nil {
+			return nil, err
+		}
+		seq.children = append(seq.children, node)
+	}
+}
+
+// parsePrimary parses a string, character class, ., group or rule reference
+func (p *gbnfParser) parsePrimary() (*gbnfNode, error) {
+	switch c := p.src[p.pos]; {
+	case c == '"':
+		p.pos++
+		var text []rune
+		for p.pos < len(p.src) && p.src[p.pos] != '"' {
+			r, err := p.readChar()
+			if err != nil {
+				return nil, err
+			}
+			text = append(text, r)
+		}
+		p.pos++
+		return &gbnfNode{kind: gbnfLiteral, text: text}, nil
+	case c == '[':
+		p.pos++
+		class := &gbnfNode{kind: gbnfClass}
+		if p.pos < len(p.src) && p.src[p.pos] == '^' {
+			class.negated = true
+			p.pos++
+		}
+		for p.pos < len(p.src) && p.src[p.pos] != ']' {
+			lo, err := p.readChar()
+			if err != nil {
+				return nil, err
+			}
+			hi := lo
+			if p.pos+1 < len(p.src) && p.src[p.pos] == '-' && p.src[p.pos+1] != ']' {
+				p.pos++
+				if hi, err = p.readChar(); err != nil {
+					return nil, err
+				}
+			}
+			class.ranges = append(class.ranges, runeRange{lo, hi})
+		}
+		p.pos++
+		return class, nil
+	case c == '.':
+		p.pos++
+		return &gbnfNode{kind: gbnfAny}, nil
+	case c == '(':
+		p.pos++
+		group, err := p.parseAlt()
+		if err != nil {
+			return nil, err
+		}
+		p.pos++ // the closing parenthesis, checked by validateGrammar
+		return group, nil
+	case isGrammarNameChar(c):
+		return &gbnfNode{kind: gbnfRef, name: p.readName()}, nil
+	default:
+		return nil, fmt.Errorf("unexpected character %q at offset %d", c, p.pos)
+	}
+}
+
+// parseRepeat parses the repetition operators following a node, if any
+func (p *gbnfParser) parseRepeat(node *gbnfNode) (*gbnfNode, error) {
+	for p.pos < len(p.src) {
+		min, max := 0, 0
+		switch p.src[p.pos] {
+		case '?':
+			min, max = 0, 1
+		case '*':
+			min, max = 0, -1
+		case '+':
+			min, max = 1, -1
+		case '{':
+			end := strings.IndexByte(p.src[p.pos:], '}')
+			bounds := strings.Split(strings.TrimSpace(p.src[p.pos+1:p.pos+end]), ",")
+			var err error
+			if min, err = strconv.Atoi(strings.TrimSpace(bounds[0])); err != nil || len(bounds) > 2 {
+				return nil, fmt.Errorf("invalid repetition at offset %d", p.pos)
+			}
+			max = min
+			if len(bounds) == 2 {
+				max = -1
+				if upper := strings.TrimSpace(bounds[1]); upper != "" {
+					if max, err = strconv.Atoi(upper); err != nil || max < min {
+						return nil, fmt.Errorf("invalid repetition at offset %d", p.pos)
+					}
+				}
+			}
+			p.pos += end
+		default:
+			return node, nil
+		}
+		p.pos++
+		node = &gbnfNode{kind: gbnfRepeat, children: []*gbnfNode{node}, min: min, max: max}
+	}
+	return node, nil
+}
+
+// readChar reads one character of a string or character class, decoding escapes
+func (p *gbnfParser) readChar() (rune, error) {
+	r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+	p.pos += size
+	if r != '\\' || p.pos >= len(p.src) {
+		return r, nil
+	}
+	e := p.src[p.pos]
+	p.pos++
+	switch e {
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case 'x', 'u', 'U':
+		digits := map[byte]int{'x': 2, 'u': 4, 'U': 8}[e]
+		if p.pos+digits > len(p.src) {
+			return 0, fmt.Errorf("invalid escape at offset %d", p.pos-2)
+		}
+		v, err := strconv.ParseUint(p.src[p.pos:p.pos+digits], 16, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid escape at offset %d", p.pos-2)
+		}
+		p.pos += digits
+		return rune(v), nil
+	default:
+		return rune(e), nil
+	}
+}
+
+// grammarMatcher checks text against parsed GBNF rules. Matching works on
+// sets of end positions, so alternatives and repetitions never backtrack
+// exponentially, and rule results are memoized per start position.
+type grammarMatcher struct {
+	rules    map[string]*gbnfNode
+	input    []rune
+	memo     map[grammarMemoKey][]int
+	active   map[grammarMemoKey]bool
+	furthest int // furthest position a character was checked at
+}
+
+type grammarMemoKey struct {
+	rule string
+	pos  int
+}
+
+// matchGrammar reports whether the whole text is accepted by the grammar's
+// root rule. When it isn't, the returned offset is the furthest character
+// the grammar got to, where the output most likely went wrong.
+func matchGrammar(rules map[string]*gbnfNode, text string) (bool, int) {
+	m := &grammarMatcher{
+		rules:  rules,
+		input:  []rune(text),
+		memo:   make(map[grammarMemoKey][]int),
+		active: make(map[grammarMemoKey]bool),
+	}
+	for _, end := range m.matchRef("root", 0) {
+		if end == len(m.input) {
+			return true, len(m.input)
+		}
+	}
+	return false, m.furthest
+}
+
+// match returns the sorted end positions of the ways node matches at pos
+func (m *grammarMatcher) match(node *gbnfNode, pos int) []int {
+	switch node.kind {
+	case gbnfLiteral:
+		for i, r := range node.text {
+			if pos+i >= len(m.input) || m.input[pos+i] != r {
+				m.reached(pos + i)
+				return nil
+			}
+		}
+		return []int{pos + len(node.text)}
+	case gbnfClass, gbnfAny:
+		if pos >= len(m.input) || !node.matchesRune(m.input[pos]) {
+			m.reached(pos)
+			return nil
+		}
+		return []int{pos + 1}
+	case gbnfRef:
+		return m.matchRef(node.name, pos)
+	case gbnfSeq:
+		ends := []int{pos}
+		for _, child := range node.children {
+			var next []int
+			for _, p := range ends {
+				next = append(next, m.match(child, p)...)
+			}
+			if ends = uniqueSorted(next); len(ends) == 0 {
+				return nil
+			}
+		}
+		return ends
+	case gbnfAlt:
+		var ends []int
+		for _, child := range node.children {
+			ends = append(ends, m.match(child, pos)...)
+		}
+		return uniqueSorted(ends)
+	case gbnfRepeat:
+		return m.matchRepeat(node, pos)
+	}
+	return nil
+}
+
+// matchRepeat matches a repetition. Unbounded repetitions stop at positions
+// reached before, so they end even when the repeated node can match the empty string.
+func (m *grammarMatcher) matchRepeat(node *gbnfNode, pos int) []int {
+	child := node.children[0]
+	current := []int{pos}
+	var ends []int
+	seen := make(map[int]bool)
+	for count := 0; len(current) > 0; count++ {
+		if count >= node.min {
+			var fresh []int
+			for _, p := range current {
+				if !seen[p] {
+					seen[p] = true
+					ends = append(ends, p)
+					fresh = append(fresh, p)
+				}
+			}
+			current = fresh
+		}
+		if count == node.max {
+			break
+		}
+		var next []int
+		for _, p := range current {
+			next = append(next, m.match(child, p)...)
+		}
+		current = uniqueSorted(next)
+	}
+	return uniqueSorted(ends)
+}
+
+// matchRef matches a rule by name, memoizing the result. Left recursion
+// matches nothing instead of looping.
+func (m *grammarMatcher) matchRef(name string, pos int) []int {
+	key := grammarMemoKey{name, pos}
+	if ends, ok := m.memo[key]; ok {
+		return ends
+	}
+	rule, ok := m.rules[name]
+	if !ok || m.active[key] {
+		return nil
+	}
+	m.active[key] = true
+	ends := m.match(rule, pos)
+	delete(m.active, key)
+	m.memo[key] = ends
+	return ends
+}
+
+// reached records that a character was checked at pos
+func (m *grammarMatcher) reached(pos int) {
+	if pos > m.furthest {
+		m.furthest = pos
+	}
+}
+
+// matchesRune reports whether a character class or . matches r
+func (n *gbnfNode) matchesRune(r rune) bool {
+	if n.kind == gbnfAny {
+		return true
+	}
+	for _, rr := range n.ranges {
+		if rr.lo <= r && r <= rr.hi {
+			return !n.negated
+		}
+	}
+	return n.negated
+}
+
+// uniqueSorted sorts positions and removes duplicates
+func uniqueSorted(positions []int) []int {
+	if len(positions) < 2 {
+		return positions
+	}
+	sort.Ints(positions)
+	out := positions[:1]
+	for _, p := range positions[1:] {
+		if p != out[len(out)-1] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Headers selecting the grammar for a single request
+const (
+	grammarFileHeader    = "X-Adapter-Grammar-File"
+	grammarInlineHeader  = "X-Adapter-Grammar-Inline"
+	disableGrammarHeader = "X-Adapter-Disable-Grammar"
+)
+
+// maxInlineGrammarSize bounds the decoded size of an X-Adapter-Grammar-Inline grammar
+const maxInlineGrammarSize = 64 << 10
+
+// grammarDirs are the --grammar-dirs directories (split once at startup)
+var grammarDirs []string
+
+// errGrammarNotAllowed is returned for grammar files outside of --grammar-dirs
+var errGrammarNotAllowed = errors.New("grammar file is outside of the allowed directories")
+
+// requestDisablesGrammar reports whether the request asked to be forwarded
+// without the grammar through X-Adapter-Disable-Grammar, which is only
+// honored with --allow-request-overrides
+func requestDisablesGrammar(r *http.Request) bool {
+	return config.AllowRequestOverrides && strings.EqualFold(strings.TrimSpace(r.Header.Get(disableGrammarHeader)), "true")
+}
+
+// requestGrammarOverride returns the grammar a request selected with the
+// X-Adapter-Grammar-File or X-Adapter-Grammar-Inline header, or nil when it
+// didn't. Files are read on every request, so edits apply right away.
+func requestGrammarOverride(r *http.Request) (*grammarSelection, error) {
+	value := strings.TrimSpace(r.Header.Get(grammarFileHeader))
+	inline := strings.TrimSpace(r.Header.Get(grammarInlineHeader))
+	if inline != "" {
+		if value != "" {
+			return nil, fmt.Errorf("only one of %s and %s may be set", grammarFileHeader, grammarInlineHeader)
+		}
+		return decodeInlineGrammar(inline)
+	}
+	if value == "" {
+		return nil, nil
+	}
+	grammarPath, err := resolveGrammarFile(value, grammarDirs)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := loadGrammarEntry(grammarPath)
+	if err != nil {
+		return nil, err
+	}
+	return &grammarSelection{Grammar: entry.content, Source: grammarPath}, nil
+}
+
+// decodeInlineGrammar decodes and validates a base64 encoded grammar
+func decodeInlineGrammar(value string) (*grammarSelection, error) {
+	if base64.StdEncoding.DecodedLen(len(value)) > maxInlineGrammarSize+3 {
+		return nil, fmt.Errorf("inline grammar exceeds %d bytes", maxInlineGrammarSize)
+	}
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		if data, err = base64.URLEncoding.DecodeString(value); err != nil {
+			return nil, fmt.Errorf("inline grammar is not valid base64: %v", err)
+		}
+	}
+	if len(data) > maxInlineGrammarSize {
+		return nil, fmt.Errorf("inline grammar exceeds %d bytes", maxInlineGrammarSize)
+	}
+	if err := validateGrammar(string(data)); err != nil {
+		return nil, fmt.Errorf("invalid inline grammar: %v", err)
+	}
+	return &grammarSelection{Grammar: string(data), Source: sourceInline}, nil
+}
+
+// resolveGrammarFile resolves a grammar file path and checks that it lies within
+// one of the allowed directories, both as given and with symlinks followed
+func resolveGrammarFile(value string, dirs []string) (string, error) {
+	abs, err := filepath.Abs(value)
+	if err != nil {
+		return "", err
+	}
+	if !withinDirs(abs, dirs, false) {
+		return "", errGrammarNotAllowed
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", fmt.Errorf("grammar file %s: %v", value, err)
+	}
+	if !withinDirs(resolved, dirs, true) {
+		return "", errGrammarNotAllowed
+	}
+	return resolved, nil
+}
+
+// withinDirs reports whether an absolute path lies within one of the directories
+func withinDirs(p string, dirs []string, followSymlinks bool) bool {
+	for _, dir := range dirs {
+		allowed, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		if followSymlinks {
+			if real, err := filepath.EvalSymlinks(allowed); err == nil {
+				allowed = real
+			}
+		}
+		rel, err := filepath.Rel(allowed, p)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
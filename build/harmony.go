@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Harmony control tokens emitted by gpt-oss models
+const (
+	tokenStart     = "<|start|>"
+	tokenChannel   = "<|channel|>"
+	tokenMessage   = "<|message|>"
+	tokenConstrain = "<|constrain|>"
+	tokenEnd       = "<|end|>"
+	tokenReturn    = "<|return|>"
+	tokenCall      = "<|call|>"
+)
+
+// Harmony channel names
+const (
+	channelAnalysis   = "analysis"
+	channelCommentary = "commentary"
+	channelFinal      = "final"
+)
+
+// Ways of combining several final channel messages of one completion
+const (
+	finalChannelsLast = "last"
+	finalChannelsJoin = "join"
+)
+
+// harmonyHeader describes the message currently being emitted by the model
+type harmonyHeader struct {
+	Role        string
+	Channel     string
+	Recipient   string
+	ContentType string
+}
+
+// harmonyChunk is a piece of message payload produced by the parser.
+// End is set once the message the chunk belongs to has been terminated.
+type harmonyChunk struct {
+	Header harmonyHeader
+	Text   string
+	End    bool
+}
+
+// harmonyParserState tracks which part of the harmony structure is being read
+type harmonyParserState int
+
+const (
+	stateText harmonyParserState = iota
+	stateRole
+	stateChannel
+	stateConstrain
+	stateMessage
+	stateIdle
+)
+
+// maxTokenLength bounds how much of a possibly split control token is held back
+const maxTokenLength = 32
+
+// harmonyParser incrementally splits harmony formatted model output into
+// message payloads. Text seen before any control token is reported with an
+// empty header so output from models that ignore the format is not lost.
+// Output is split into control tokens and text by tokenizeHarmony; a control
+// token split across two pieces of output is held back until it is complete,
+// so partial tokens are never emitted as text.
+type harmonyParser struct {
+	pending   string
+	state     harmonyParserState
+	role      strings.Builder
+	channel   strings.Builder
+	constrain strings.Builder
+	header    harmonyHeader
+}
+
+// feed consumes the next piece of model output and returns the payload chunks it contains
+func (p *harmonyParser) feed(s string) []harmonyChunk {
+	var chunks []harmonyChunk
+	s, p.pending = p.pending+s, ""
+	cut := harmonyHoldback(s)
+	for _, t := range tokenizeHarmony(s[:cut]) {
+		if t.Kind == harmonyControl {
+			chunks = p.handleToken(chunks, t.Value)
+		} else {
+			chunks = p.appendText(chunks, t.Value)
+		}
+	}
+	p.pending = s[cut:]
+	return chunks
+}
+
+// harmonyHoldback returns where the part of s that may be the start of a
+// control token split across two pieces of output begins, len(s) if none
+func harmonyHoldback(s string) int {
+	if i := strings.LastIndex(s, "<|"); i >= 0 && !strings.Contains(s[i:], "|>") && len(s)-i < maxTokenLength {
+		// The rest of the token may arrive with the next piece of output
+		return i
+	}
+	if strings.HasSuffix(s, "<") {
+		// A lone "<" may be the start of a token split right after it
+		return len(s) - 1
+	}
+	return len(s)
+}
+
+// flush terminates the message in progress, if any, at the end of the output.
+// Held back text that never became a control token is emitted first.
+func (p *harmonyParser) flush() []harmonyChunk {
+	var chunks []harmonyChunk
+	if p.pending != "" {
+		chunks = p.appendText(chunks, p.pending)
+		p.pending = ""
+	}
+	if p.state == stateMessage {
+		p.state = stateIdle
+		chunks = append(chunks, harmonyChunk{Header: p.header, End: true})
+	}
+	return chunks
+}
+
+// appendText routes plain text to the part of the structure currently being read
+func (p *harmonyParser) appendText(chunks []harmonyChunk, text string) []harmonyChunk {
+	switch p.state {
+	case stateRole:
+		p.role.WriteString(text)
+	case stateChannel:
+		p.channel.WriteString(text)
+	case stateConstrain:
+		p.constrain.WriteString(text)
+	case stateText, stateMessage:
+		chunks = append(chunks, harmonyChunk{Header: p.header, Text: text})
+	}
+	return chunks
+}
+
+// handleToken advances the parser state for a single control token
+func (p *harmonyParser) handleToken(chunks []harmonyChunk, token string) []harmonyChunk {
+	switch token {
+	case tokenStart:
+		chunks = append(chunks, p.flush()...)
+		p.resetHeader()
+		p.state = stateRole
+	case tokenChannel:
+		if p.state != stateRole {
+			chunks = append(chunks, p.flush()...)
+			p.resetHeader()
+		}
+		p.state = stateChannel
+	case tokenConstrain:
+		p.state = stateConstrain
+	case tokenMessage:
+		p.header = parseHarmonyHeader(p.role.String(), p.channel.String(), p.constrain.String())
+		p.state = stateMessage
+	case tokenEnd, tokenReturn, tokenCall:
+		chunks = append(chunks, p.flush()...)
+		p.state = stateIdle
+	}
+	return chunks
+}
+
+// resetHeader clears the header collected for the previous message
+func (p *harmonyParser) resetHeader() {
+	p.role.Reset()
+	p.channel.Reset()
+	p.constrain.Reset()
+	p.header = harmonyHeader{}
+}
+
+// parseHarmonyHeader builds a message header from the raw role, channel and constrain parts.
+// The recipient ("to=functions.NAME") may appear either after the role or after the channel.
+func parseHarmonyHeader(role, channel, constrain string) harmonyHeader {
+	var h harmonyHeader
+	for i, field := range strings.Fields(role) {
+		if strings.HasPrefix(field, "to=") {
+			h.Recipient = strings.TrimPrefix(field, "to=")
+		} else if i == 0 {
+			h.Role = field
+		}
+	}
+	for i, field := range strings.Fields(channel) {
+		if strings.HasPrefix(field, "to=") {
+			h.Recipient = strings.TrimPrefix(field, "to=")
+		} else if i == 0 {
+			h.Channel = field
+		} else if h.ContentType == "" {
+			h.ContentType = field
+		}
+	}
+	if fields := strings.Fields(constrain); len(fields) > 0 {
+		h.ContentType = fields[0]
+	}
+	return h
+}
+
+// harmonyMessage is a complete message parsed from harmony formatted output
+type harmonyMessage struct {
+	Header  harmonyHeader
+	Content string
+}
+
+// parseHarmonyMessages splits complete harmony formatted output into messages
+func parseHarmonyMessages(s string) []harmonyMessage {
+	var p harmonyParser
+	chunks := append(p.feed(s), p.flush()...)
+
+	var messages []harmonyMessage
+	var current *harmonyMessage
+	for _, c := range chunks {
+		if current == nil || current.Header != c.Header {
+			messages = append(messages, harmonyMessage{Header: c.Header})
+			current = &messages[len(messages)-1]
+		}
+		current.Content += c.Text
+		if c.End {
+			current = nil
+		}
+	}
+	return messages
+}
+
+// parseHarmonyResponse extracts tool calls addressed to functions.NAME from harmony
+// formatted output, in the order they appear and numbered from 0. Their IDs
+// are derived from scope, see makeToolCallID. The returned text holds the
+// final channel content with all harmony markup removed, see collapseFinals.
+// Text outside of any message is only used when there is none.
+func parseHarmonyResponse(content, scope string) (cleanText string, calls []ToolCall) {
+	var finals []string
+	var text strings.Builder
+	for _, m := range parseHarmonyMessages(content) {
+		if strings.HasPrefix(m.Header.Recipient, "functions.") {
+			var call ToolCall
+			call.Type = "function"
+			call.Function.Name = strings.TrimPrefix(m.Header.Recipient, "functions.")
+			call.Function.Arguments = normalizeArguments(m.Content)
+			call.Index = len(calls)
+			call.ID = makeToolCallID(scope, call.Function.Name, call.Index)
+			calls = append(calls, call)
+			continue
+		}
+		switch m.Header.Channel {
+		case channelFinal:
+			finals = append(finals, m.Content)
+		case "":
+			text.WriteString(m.Content)
+		}
+	}
+	if final := collapseFinals(finals); final != "" {
+		return final, calls
+	}
+	return strings.TrimSpace(text.String()), calls
+}
+
+// collapseFinals combines the final channel messages of a completion. gpt-oss
+// occasionally emits more than one; with --final-channels last the last one
+// with any text is authoritative, with join they are joined with
+// --final-separator.
+func collapseFinals(finals []string) string {
+	var texts []string
+	for _, f := range finals {
+		if text := strings.TrimSpace(f); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	if len(texts) == 0 {
+		return ""
+	}
+	if config.FinalChannels == finalChannelsJoin {
+		return strings.Join(texts, config.FinalSeparator)
+	}
+	return texts[len(texts)-1]
+}
+
+// limitToolCalls keeps the first max calls, returning how many were dropped.
+// A max of 0 keeps all of them.
+func limitToolCalls(calls []ToolCall, max int) ([]ToolCall, int) {
+	if max <= 0 || len(calls) <= max {
+		return calls, 0
+	}
+	return calls[:max], len(calls) - max
+}
+
+// parseHarmonyReasoning returns the text of the analysis channel, if any
+func parseHarmonyReasoning(content string) string {
+	var parts []string
+	for _, m := range parseHarmonyMessages(content) {
+		if m.Header.Channel == channelAnalysis && m.Header.Recipient == "" {
+			if text := strings.TrimSpace(m.Content); text != "" {
+				parts = append(parts, text)
+			}
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// maxArgumentUnwrap bounds how many levels of string escaping are removed
+const maxArgumentUnwrap = 3
+
+// normalizeArguments turns the tool call arguments emitted by the model into a
+// JSON document clients can parse. Arguments emitted as a string-escaped blob
+// ("{\"path\":\"a\"}") are unwrapped and trailing commas are removed. Empty
+// arguments become {} and text that still isn't JSON is wrapped as {"input": text}.
+func normalizeArguments(raw string) string {
+	s := strings.TrimSpace(raw)
+	if s == "" {
+		return "{}"
+	}
+	for i := 0; i < maxArgumentUnwrap; i++ {
+		if !json.Valid([]byte(s)) {
+			if fixed := removeTrailingCommas(s); json.Valid([]byte(fixed)) {
+				s = fixed
+			} else {
+				break
+			}
+		}
+		var inner string
+		if err := json.Unmarshal([]byte(s), &inner); err != nil {
+			// A JSON value that isn't a string, use it as is
+			var buf bytes.Buffer
+			if err := json.Compact(&buf, []byte(s)); err != nil {
+				return s
+			}
+			return buf.String()
+		}
+		s = strings.TrimSpace(inner)
+		if s == "" {
+			return "{}"
+		}
+	}
+
+	wrapped, err := json.Marshal(map[string]string{"input": s})
+	if err != nil {
+		return "{}"
+	}
+	return string(wrapped)
+}
+
+// removeTrailingCommas drops commas directly followed by a closing bracket or
+// brace, ignoring commas inside strings
+func removeTrailingCommas(s string) string {
+	var out strings.Builder
+	inString, escaped := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if inString {
+			out.WriteByte(c)
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		if c == ',' {
+			rest := strings.TrimLeft(s[i+1:], " \t\r\n")
+			if strings.HasPrefix(rest, "}") || strings.HasPrefix(rest, "]") {
+				continue
+			}
+		}
+		if c == '"' {
+			inString = true
+		}
+		out.WriteByte(c)
+	}
+	return out.String()
+}
+
+// analysisEllipsis marks analysis text cut off by --max-analysis-chars
+const analysisEllipsis = "…"
+
+// truncateAnalysis cuts analysis text down to max characters, 0 means unlimited
+func truncateAnalysis(s string, max int) string {
+	if max <= 0 {
+		return s
+	}
+	n := 0
+	for i := range s {
+		if n == max {
+			return s[:i] + analysisEllipsis
+		}
+		n++
+	}
+	return s
+}
+
+// toolCallScope identifies a choice of a completion for makeToolCallID
+func toolCallScope(completionID string, choice int) string {
+	return completionID + "/" + strconv.Itoa(choice)
+}
+
+// makeToolCallID derives an OpenAI style tool call ID from the completion
+// choice the call belongs to (see toolCallScope), its function name and its
+// index, so identical model output gets identical IDs while calls of different
+// completions don't collide. The arguments aren't part of it: a streamed call
+// gets its ID before they are known, and both paths must agree.
+func makeToolCallID(scope, fn string, idx int) string {
+	h := sha256.New()
+	h.Write([]byte(scope))
+	h.Write([]byte{0})
+	h.Write([]byte(fn))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.Itoa(idx)))
+	return "call_" + hex.EncodeToString(h.Sum(nil)[:12])
+}
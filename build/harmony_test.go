@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// feedAll runs the pieces through a harmonyParser and joins the payload of
+// consecutive chunks with the same header, like parseHarmonyMessages does.
+func feedAll(pieces ...string) []harmonyMessage {
+	var p harmonyParser
+	var chunks []harmonyChunk
+	for _, piece := range pieces {
+		chunks = append(chunks, p.feed(piece)...)
+	}
+	chunks = append(chunks, p.flush()...)
+
+	var messages []harmonyMessage
+	for _, c := range chunks {
+		if c.Text == "" {
+			continue
+		}
+		if n := len(messages); n > 0 && messages[n-1].Header == c.Header {
+			messages[n-1].Content += c.Text
+			continue
+		}
+		messages = append(messages, harmonyMessage{Header: c.Header, Content: c.Text})
+	}
+	return messages
+}
+
+func TestParseHarmonyResponseStrayTokenStart(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"before return", "<|channel|>final<|message|>x <| y<|return|>", "x <| y"},
+		{"before end", "<|channel|>final<|message|>a<|b <|end|>", "a<|b"},
+		{"unknown token", "<|channel|>final<|message|>a <|foo|> b<|return|>", "a <|foo|> b"},
+		{"several", "<|channel|>final<|message|>1 <| 2 <| 3<|return|>", "1 <| 2 <| 3"},
+		{"at end", "<|channel|>final<|message|>x <|", "x <|"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := parseHarmonyResponse(tt.content, "")
+			if got != tt.want {
+				t.Errorf("parseHarmonyResponse(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHarmonyParserSplitTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"final", "<|channel|>final<|message|>Hello there<|return|>"},
+		{"analysis and final", "<|channel|>analysis<|message|>Think.<|end|><|start|>assistant<|channel|>final<|message|>Done.<|return|>"},
+		{"tool call", "<|start|>assistant<|channel|>commentary to=functions.read_file <|constrain|>json<|message|>{\"path\":\"a.go\"}<|call|>"},
+		{"stray token start", "<|channel|>final<|message|>x <| y and a < b<|return|>"},
+		{"no markup", "plain text from a model ignoring the format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := feedAll(tt.content)
+			for i := 1; i < len(tt.content); i++ {
+				got := feedAll(tt.content[:i], tt.content[i:])
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("split at %d (%q | %q): got %+v, want %+v", i, tt.content[:i], tt.content[i:], got, want)
+				}
+			}
+			bytes := make([]string, len(tt.content))
+			for i := range tt.content {
+				bytes[i] = tt.content[i : i+1]
+			}
+			if got := feedAll(bytes...); !reflect.DeepEqual(got, want) {
+				t.Errorf("byte by byte: got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestHarmonyParserNeverEmitsPartialTokens(t *testing.T) {
+	var p harmonyParser
+	pieces := []string{"<|channel|>final<|mes", "sage|>Hi<|ret", "urn|>"}
+	for _, piece := range pieces {
+		for _, c := range p.feed(piece) {
+			if c.Text != "" && c.Text != "Hi" {
+				t.Errorf("feed(%q) emitted %q", piece, c.Text)
+			}
+		}
+	}
+}
+
+func TestMakeToolCallID(t *testing.T) {
+	id := makeToolCallID(toolCallScope("chatcmpl-1", 0), "read_file", 0)
+	if again := makeToolCallID(toolCallScope("chatcmpl-1", 0), "read_file", 0); again != id {
+		t.Errorf("makeToolCallID is not deterministic: %q != %q", again, id)
+	}
+	if !strings.HasPrefix(id, "call_") {
+		t.Errorf("makeToolCallID = %q, want a call_ prefix", id)
+	}
+
+	seen := map[string]string{id: "chatcmpl-1/0 read_file 0"}
+	for _, tt := range []struct {
+		completion string
+		choice     int
+		fn         string
+		idx        int
+	}{
+		{"chatcmpl-2", 0, "read_file", 0},
+		{"chatcmpl-1", 1, "read_file", 0},
+		{"chatcmpl-1", 0, "write_file", 0},
+		{"chatcmpl-1", 0, "read_file", 1},
+		{"", 0, "read_file", 0},
+	} {
+		desc := fmt.Sprintf("%s/%d %s %d", tt.completion, tt.choice, tt.fn, tt.idx)
+		got := makeToolCallID(toolCallScope(tt.completion, tt.choice), tt.fn, tt.idx)
+		if other, ok := seen[got]; ok {
+			t.Errorf("%s and %s both get ID %q", desc, other, got)
+		}
+		seen[got] = desc
+	}
+}
+
+func TestToolCallIDsMatchAcrossPaths(t *testing.T) {
+	const output = "<|channel|>commentary to=functions.read_file <|constrain|>json<|message|>{\"path\":\"a.go\"}<|call|>" +
+		"<|start|>assistant<|channel|>commentary to=functions.read_file <|constrain|>json<|message|>{\"path\":\"b.go\"}<|call|>"
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	completion := fmt.Sprintf(`{"id":"chatcmpl-7","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":%q}}]}`, output)
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(completion)),
+		Request:    req,
+	}
+	if err := rewriteHarmonyResponse(resp); err != nil {
+		t.Fatal(err)
+	}
+	var rewritten ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rewritten); err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, call := range rewritten.Choices[0].Message.ToolCalls {
+		want = append(want, call.ID)
+	}
+	if len(want) != 2 || want[0] == want[1] {
+		t.Fatalf("non-streamed tool call IDs = %q, want two distinct IDs", want)
+	}
+
+	var sse strings.Builder
+	for _, piece := range splitRunes(output, 5) {
+		fmt.Fprintf(&sse, "data: {\"id\":\"chatcmpl-7\",\"object\":\"chat.completion.chunk\",\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", piece)
+	}
+	sse.WriteString("data: {\"id\":\"chatcmpl-7\",\"object\":\"chat.completion.chunk\",\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n")
+	resp.Body = ioutil.NopCloser(strings.NewReader(sse.String()))
+	streamed, err := ioutil.ReadAll(newHarmonyStreamFilter(resp.Body, newResponseIdentity(req)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range strings.Split(string(streamed), "\n") {
+		data := strings.TrimPrefix(line, "data: ")
+		if data == line || data == "[DONE]" {
+			continue
+		}
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		for _, choice := range chunk.Choices {
+			for _, d := range choice.Delta.ToolCalls {
+				if d.ID != "" {
+					got = append(got, d.ID)
+				}
+			}
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("streamed tool call IDs = %q, want %q", got, want)
+	}
+}
+
+func TestNormalizeArguments(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"valid object", `{"path": "a.go"}`, `{"path":"a.go"}`},
+		{"nested", `{"a": [1, 2], "b": {"c": null}}`, `{"a":[1,2],"b":{"c":null}}`},
+		{"empty", "", "{}"},
+		{"whitespace", " \n\t", "{}"},
+		{"trailing comma in object", `{"path": "a.go",}`, `{"path":"a.go"}`},
+		{"trailing comma in array", `{"paths": ["a", "b", ]}`, `{"paths":["a","b"]}`},
+		{"comma kept in a string", `{"text": "a,}"}`, `{"text":"a,}"}`},
+		{"double-escaped", `"{\"path\":\"a.go\"}"`, `{"path":"a.go"}`},
+		{"triple-escaped", `"\"{\\\"path\\\":\\\"a.go\\\"}\""`, `{"path":"a.go"}`},
+		{"escaped with trailing comma", `"{\"path\":\"a.go\",}"`, `{"path":"a.go"}`},
+		{"escaped empty string", `""`, "{}"},
+		{"plain text", "list the files", `{"input":"list the files"}`},
+		{"truncated", `{"path": "a.go`, `{"input":"{\"path\": \"a.go"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := normalizeArguments(tt.raw)
+			if got != tt.want {
+				t.Errorf("normalizeArguments(%q) = %s, want %s", tt.raw, got, tt.want)
+			}
+			if !json.Valid([]byte(got)) {
+				t.Errorf("normalizeArguments(%q) = %s, not valid JSON", tt.raw, got)
+			}
+		})
+	}
+}
+
+func TestParseHarmonyResponseMultipleToolCalls(t *testing.T) {
+	// call formats a tool call the way gpt-oss emits it after the first message
+	call := func(name, args string) string {
+		return "<|start|>assistant<|channel|>commentary to=functions." + name + " <|constrain|>json<|message|>" + args + "<|call|>"
+	}
+	type wantCall struct{ name, args string }
+	tests := []struct {
+		name    string
+		content string
+		want    []wantCall
+	}{
+		{
+			name: "two calls",
+			content: "<|channel|>analysis<|message|>Read both files.<|end|>" +
+				call("read_file", `{"path":"a.go"}`) + call("read_file", `{"path":"b.go"}`),
+			want: []wantCall{{"read_file", `{"path":"a.go"}`}, {"read_file", `{"path":"b.go"}`}},
+		},
+		{
+			name: "three calls with analysis in between",
+			content: "<|channel|>analysis<|message|>List, then search.<|end|>" +
+				call("list_files", `{"path":"."}`) +
+				"<|start|>assistant<|channel|>analysis<|message|>Also search.<|end|>" +
+				call("search_files", `{"regex":"TODO"}`) + call("write_to_file", `{"path":"c.go","content":"package c"}`),
+			want: []wantCall{
+				{"list_files", `{"path":"."}`},
+				{"search_files", `{"regex":"TODO"}`},
+				{"write_to_file", `{"path":"c.go","content":"package c"}`},
+			},
+		},
+		{
+			name:    "calls without a start token",
+			content: strings.TrimPrefix(call("a", "{}"), "<|start|>assistant") + strings.TrimPrefix(call("b", "{}"), "<|start|>assistant"),
+			want:    []wantCall{{"a", "{}"}, {"b", "{}"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, calls := parseHarmonyResponse(tt.content, "chatcmpl-1/0")
+			if text != "" {
+				t.Errorf("text = %q, want none", text)
+			}
+			if len(calls) != len(tt.want) {
+				t.Fatalf("got %d tool calls, want %d: %+v", len(calls), len(tt.want), calls)
+			}
+			ids := make(map[string]bool)
+			for i, c := range calls {
+				if c.Index != i || c.Function.Name != tt.want[i].name || c.Function.Arguments != tt.want[i].args {
+					t.Errorf("call %d = #%d %s(%s), want #%d %s(%s)", i, c.Index, c.Function.Name, c.Function.Arguments,
+						i, tt.want[i].name, tt.want[i].args)
+				}
+				if ids[c.ID] {
+					t.Errorf("call %d reuses the ID %s", i, c.ID)
+				}
+				ids[c.ID] = true
+			}
+		})
+	}
+}
+
+func TestCollapseFinals(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		finals []string
+		want   string
+	}{
+		{"none", finalChannelsLast, nil, ""},
+		{"one", finalChannelsLast, []string{" Done. "}, "Done."},
+		{"last wins", finalChannelsLast, []string{"Draft.", "Done."}, "Done."},
+		{"empty last is skipped", finalChannelsLast, []string{"Done.", " \n"}, "Done."},
+		{"join", finalChannelsJoin, []string{"Part one.", "Part two."}, "Part one. | Part two."},
+		{"join skips empty", finalChannelsJoin, []string{"Part one.", "", "Part two."}, "Part one. | Part two."},
+		{"all empty", finalChannelsJoin, []string{"", " "}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.FinalChannels = tt.mode
+			cfg.FinalSeparator = " | "
+			useConfig(t, cfg)
+			if got := collapseFinals(tt.finals); got != tt.want {
+				t.Errorf("collapseFinals(%q) = %q, want %q", tt.finals, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHarmonyResponseDuplicateFinal(t *testing.T) {
+	// gpt-oss 20b starting the final answer over
+	const content = "<|channel|>analysis<|message|>Answer.<|end|>" +
+		"<|start|>assistant<|channel|>final<|message|>The answer is<|end|>" +
+		"<|start|>assistant<|channel|>final<|message|>The answer is 42.<|return|>"
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{finalChannelsLast, "The answer is 42."},
+		{finalChannelsJoin, "The answer is\n\nThe answer is 42."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.FinalChannels = tt.mode
+			useConfig(t, cfg)
+			if got, _ := parseHarmonyResponse(content, ""); got != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
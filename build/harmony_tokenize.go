@@ -0,0 +1,81 @@
+package main
+
+import "strings"
+
+// harmonyTokenKind classifies a span of harmony formatted output
+type harmonyTokenKind int
+
+const (
+	// harmonyText is text outside of any message, e.g. from models ignoring the format
+	harmonyText harmonyTokenKind = iota
+	// harmonyControl is a control token such as <|start|> or <|message|>
+	harmonyControl
+	// harmonyRole is the role (and optional recipient) following <|start|>
+	harmonyRole
+	// harmonyChannel is the channel name (and optional recipient) following <|channel|>
+	harmonyChannel
+	// harmonyContentType is the content type following <|constrain|>
+	harmonyContentType
+	// harmonyPayload is message content following <|message|>
+	harmonyPayload
+)
+
+// harmonyToken is a classified span of harmony formatted output. Value is a
+// substring of the tokenized input.
+type harmonyToken struct {
+	Kind  harmonyTokenKind
+	Value string
+}
+
+// tokenizeHarmony splits harmony formatted output into classified spans. It
+// accepts any input: unknown or truncated control tokens are kept as part of
+// the surrounding span, and concatenating all values gives back the input.
+func tokenizeHarmony(s string) []harmonyToken {
+	tokens := make([]harmonyToken, 0, 2*strings.Count(s, "<|")+1)
+	kind := harmonyText
+	spanStart, pos := 0, 0
+	for {
+		idx := strings.Index(s[pos:], "<|")
+		if idx < 0 {
+			break
+		}
+		tokenStart := pos + idx
+		end := strings.Index(s[tokenStart:], "|>")
+		if end < 0 {
+			break
+		}
+		tokenEnd := tokenStart + end + 2
+		if next := strings.Index(s[tokenStart+2:tokenEnd], "<|"); next >= 0 {
+			// A stray "<|" stays part of the span, the next one may start a token
+			pos = tokenStart + 2 + next
+			continue
+		}
+		pos = tokenEnd
+
+		next, ok := harmonyTokenKinds[s[tokenStart:tokenEnd]]
+		if !ok {
+			// Not a control token we know about, it stays part of the span
+			continue
+		}
+		if tokenStart > spanStart {
+			tokens = append(tokens, harmonyToken{Kind: kind, Value: s[spanStart:tokenStart]})
+		}
+		tokens = append(tokens, harmonyToken{Kind: harmonyControl, Value: s[tokenStart:tokenEnd]})
+		kind, spanStart = next, tokenEnd
+	}
+	if len(s) > spanStart {
+		tokens = append(tokens, harmonyToken{Kind: kind, Value: s[spanStart:]})
+	}
+	return tokens
+}
+
+// harmonyTokenKinds maps each control token to the kind of the span following it
+var harmonyTokenKinds = map[string]harmonyTokenKind{
+	tokenStart:     harmonyRole,
+	tokenChannel:   harmonyChannel,
+	tokenConstrain: harmonyContentType,
+	tokenMessage:   harmonyPayload,
+	tokenEnd:       harmonyText,
+	tokenReturn:    harmonyText,
+	tokenCall:      harmonyText,
+}
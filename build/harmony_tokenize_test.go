@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenizeHarmony(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []harmonyToken
+	}{
+		{"empty", "", []harmonyToken{}},
+		{"plain text", "hello", []harmonyToken{{harmonyText, "hello"}}},
+		{
+			"message",
+			"<|start|>assistant<|channel|>final<|message|>Hi<|return|>",
+			[]harmonyToken{
+				{harmonyControl, "<|start|>"}, {harmonyRole, "assistant"},
+				{harmonyControl, "<|channel|>"}, {harmonyChannel, "final"},
+				{harmonyControl, "<|message|>"}, {harmonyPayload, "Hi"},
+				{harmonyControl, "<|return|>"},
+			},
+		},
+		{
+			"tool call",
+			"<|channel|>commentary to=functions.f <|constrain|>json<|message|>{}<|call|>",
+			[]harmonyToken{
+				{harmonyControl, "<|channel|>"}, {harmonyChannel, "commentary to=functions.f "},
+				{harmonyControl, "<|constrain|>"}, {harmonyContentType, "json"},
+				{harmonyControl, "<|message|>"}, {harmonyPayload, "{}"},
+				{harmonyControl, "<|call|>"},
+			},
+		},
+		{
+			"unknown token",
+			"<|message|>a <|foo|> b<|end|>",
+			[]harmonyToken{
+				{harmonyControl, "<|message|>"}, {harmonyPayload, "a <|foo|> b"},
+				{harmonyControl, "<|end|>"},
+			},
+		},
+		{
+			"stray token start",
+			"<|message|>x <| y<|return|>",
+			[]harmonyToken{
+				{harmonyControl, "<|message|>"}, {harmonyPayload, "x <| y"},
+				{harmonyControl, "<|return|>"},
+			},
+		},
+		{
+			"truncated token",
+			"<|message|>x<|ret",
+			[]harmonyToken{{harmonyControl, "<|message|>"}, {harmonyPayload, "x<|ret"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenizeHarmony(tt.input); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tokenizeHarmony(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzTokenizeHarmony(f *testing.F) {
+	f.Add("")
+	f.Add("plain text")
+	f.Add("<|start|>assistant<|channel|>final<|message|>Hi<|return|>")
+	f.Add("<|channel|>commentary to=functions.f <|constrain|>json<|message|>{}<|call|>")
+	f.Add("x <| y<|return|>")
+	f.Add("<|<||>|><|end")
+	f.Fuzz(func(t *testing.T, s string) {
+		var joined strings.Builder
+		for _, token := range tokenizeHarmony(s) {
+			if token.Value == "" {
+				t.Fatalf("tokenizeHarmony(%q) returned an empty %v token", s, token.Kind)
+			}
+			if _, ok := harmonyTokenKinds[token.Value]; ok != (token.Kind == harmonyControl) {
+				t.Fatalf("tokenizeHarmony(%q) classified %q as %v", s, token.Value, token.Kind)
+			}
+			joined.WriteString(token.Value)
+		}
+		if joined.String() != s {
+			t.Fatalf("tokens of %q join to %q", s, joined.String())
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// healthzTimeout bounds the upstream check so probes don't hang
+const healthzTimeout = 2 * time.Second
+
+// healthzClient is used for the upstream reachability check. main gives it
+// the upstream transport, so the check trusts the same certificates.
+var healthzClient = &http.Client{Timeout: healthzTimeout}
+
+// HealthStatus is the body returned by /healthz
+type HealthStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleHealthz reports whether the adapter (and optionally the upstream) is up
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	health := HealthStatus{Status: "ok"}
+
+	if config.HealthzCheckUpstream {
+		if err := checkUpstream(); err != nil {
+			status = http.StatusServiceUnavailable
+			health = HealthStatus{Status: "unavailable", Error: err.Error()}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(health)
+}
+
+// checkUpstream reports an error when none of the upstream targets is reachable
+func checkUpstream() error {
+	var errs []string
+	for _, up := range upstreams {
+		err := checkTarget(up.target.String())
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// checkTarget does a lightweight GET against an upstream's /models endpoint
+func checkTarget(target string) error {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(target, "/")+"/models", nil)
+	if err != nil {
+		return err
+	}
+	if config.UpstreamAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+config.UpstreamAPIKey)
+	}
+
+	resp, err := healthzClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("upstream %s unreachable: %v", target, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("upstream %s returned %s", target, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The upstream check trusts the --upstream-ca-file certificates like the proxy does
+func TestCheckTargetUsesUpstreamTLS(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"object":"list","data":[]}`))
+	}))
+	defer upstream.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})
+	if err := os.WriteFile(caFile, cert, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.UpstreamCAFile = caFile
+	useConfig(t, cfg)
+
+	saved := healthzClient.Transport
+	defer func() { healthzClient.Transport = saved }()
+
+	healthzClient.Transport = http.DefaultTransport
+	if err := checkTarget(upstream.URL + "/v1"); err == nil {
+		t.Error("checkTarget trusted a certificate outside of the system roots")
+	}
+
+	transport, err := newUpstreamTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	healthzClient.Transport = transport
+	if err := checkTarget(upstream.URL + "/v1"); err != nil {
+		t.Errorf("checkTarget with the upstream transport: %v", err)
+	}
+}
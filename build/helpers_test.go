@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testConfig returns the default config with the grammar shipped next to the
+// sources, which the tests run from
+func testConfig() Config {
+	cfg := defaultConfig()
+	cfg.GrammarFile = "cline.gbnf"
+	return cfg
+}
+
+// useConfig installs cfg as the global config for the rest of the test, along
+// with the settings main derives from it at startup
+func useConfig(t testing.TB, cfg Config) {
+	t.Helper()
+	saved := struct {
+		config             Config
+		roleMap            map[string]string
+		disabledModels     []string
+		grammarModels      []string
+		injectPaths        []string
+		passthroughPaths   []string
+		disabledTransforms []string
+		corsOrigins        []string
+	}{config, roleMap, disabledModels, grammarModels, injectPaths, passthroughPaths, disabledTransforms, corsOrigins}
+	t.Cleanup(func() {
+		config, roleMap = saved.config, saved.roleMap
+		disabledModels, grammarModels = saved.disabledModels, saved.grammarModels
+		injectPaths, passthroughPaths = saved.injectPaths, saved.passthroughPaths
+		disabledTransforms, corsOrigins = saved.disabledTransforms, saved.corsOrigins
+	})
+
+	var err error
+	if roleMap, err = parseRoleMap(cfg.RoleMap); err != nil {
+		t.Fatal(err)
+	}
+	config = cfg
+	disabledModels = splitList(cfg.DisableForModels)
+	grammarModels = splitList(cfg.GrammarModels)
+	injectPaths = splitList(cfg.InjectPaths)
+	passthroughPaths = splitList(cfg.PassthroughPaths)
+	disabledTransforms = splitList(cfg.DisableTransforms)
+	corsOrigins = splitList(cfg.CORSOrigins)
+}
+
+// waitFor polls cond until it holds, failing the test after a second
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within a second")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
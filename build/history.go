@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// assistantHistoryTransform cleans harmony markup out of the assistant
+// messages of the conversation history. A turn the adapter didn't clean, e.g.
+// one sent with the transforms disabled, would otherwise show the model its
+// own control tokens as plain text and confuse it. User and tool messages are
+// left alone.
+type assistantHistoryTransform struct{}
+
+func (assistantHistoryTransform) Name() string { return "assistant-history" }
+
+func (assistantHistoryTransform) TransformRequest(state *requestTransformState) {
+	if !state.mayContain("<|") {
+		return
+	}
+	if raw, ok := state.decoded(); ok && cleanAssistantHistory(raw, isOllamaNativeChat(state.Path)) {
+		state.changed()
+	}
+}
+
+// cleanAssistantHistory replaces the content of every assistant message
+// holding harmony markup with its final channel text. Tool calls found in the
+// markup become tool_calls of the message unless it already has some, in the
+// native layout (arguments as an object) or the OpenAI one (arguments as a
+// string). The analysis channel is dropped, gpt-oss doesn't expect its
+// reasoning in the history. It reports whether any message was changed.
+func cleanAssistantHistory(raw map[string]interface{}, native bool) bool {
+	messages, ok := raw["messages"].([]interface{})
+	if !ok {
+		return false
+	}
+	changed := false
+	for i, m := range messages {
+		message, ok := m.(map[string]interface{})
+		if ok && message["role"] == "assistant" && cleanAssistantMessage(message, native, historyScope(i)) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// cleanAssistantMessage replaces the content of an assistant message holding
+// harmony markup, as described for cleanAssistantHistory. scope is passed on
+// to parseHarmonyResponse. It reports whether the message was changed.
+func cleanAssistantMessage(message map[string]interface{}, native bool, scope string) bool {
+	content, ok := message["content"].(string)
+	if !ok || !containsHarmonyMarkup(content) {
+		return false
+	}
+	text, calls := parseHarmonyResponse(content, scope)
+	message["content"] = text
+	if existing, _ := message["tool_calls"].([]interface{}); len(existing) == 0 && len(calls) > 0 {
+		message["tool_calls"] = historyToolCalls(calls, native)
+	}
+	return true
+}
+
+// historyScope is the tool call scope of the message at position i of the
+// history. The completion the calls came from is unknown by now, but the
+// position keeps the IDs of different turns apart and stays the same on the
+// following requests of the conversation.
+func historyScope(i int) string {
+	return toolCallScope("history", i)
+}
+
+// containsHarmonyMarkup reports whether text holds any harmony control token
+func containsHarmonyMarkup(text string) bool {
+	if !strings.Contains(text, "<|") {
+		return false
+	}
+	for token := range harmonyTokenKinds {
+		if strings.Contains(text, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// historyToolCalls turns parsed tool calls into the tool_calls of a request message
+func historyToolCalls(calls []ToolCall, native bool) []interface{} {
+	out := make([]interface{}, 0, len(calls))
+	for _, call := range calls {
+		if !native {
+			out = append(out, call)
+			continue
+		}
+		var arguments interface{}
+		if err := json.Unmarshal([]byte(call.Function.Arguments), &arguments); err != nil {
+			arguments = map[string]interface{}{}
+		}
+		out = append(out, map[string]interface{}{
+			"function": map[string]interface{}{
+				"name":      call.Function.Name,
+				"arguments": arguments,
+			},
+		})
+	}
+	return out
+}
+
+// thinkingFields are the message fields clients send back the reasoning of
+// earlier assistant turns in
+var thinkingFields = []string{"reasoning_content", "reasoning", "thinking"}
+
+// stripThinkingTransform removes the reasoning of earlier assistant turns
+// from the history with --strip-thinking, keeping the context small over a
+// long session. The turn in progress, the assistant messages after the last
+// user message, keeps its reasoning: gpt-oss relies on it between tool calls.
+type stripThinkingTransform struct{}
+
+func (stripThinkingTransform) Name() string { return "strip-thinking" }
+
+func (stripThinkingTransform) TransformRequest(state *requestTransformState) {
+	if !config.StripThinking {
+		return
+	}
+	if raw, ok := state.decoded(); ok && stripThinking(raw, isOllamaNativeChat(state.Path)) {
+		state.changed()
+	}
+}
+
+// stripThinking removes the thinking fields and any analysis channel left in
+// the content from the assistant messages before the last user message. It
+// reports whether any message was changed.
+func stripThinking(raw map[string]interface{}, native bool) bool {
+	messages, ok := raw["messages"].([]interface{})
+	if !ok {
+		return false
+	}
+	lastUser := -1
+	for i, m := range messages {
+		if message, ok := m.(map[string]interface{}); ok && message["role"] == "user" {
+			lastUser = i
+		}
+	}
+
+	changed := false
+	for i, m := range messages[:lastUser+1] {
+		message, ok := m.(map[string]interface{})
+		if !ok || message["role"] != "assistant" {
+			continue
+		}
+		for _, field := range thinkingFields {
+			if _, ok := message[field]; ok {
+				delete(message, field)
+				changed = true
+			}
+		}
+		if cleanAssistantMessage(message, native, historyScope(i)) {
+			changed = true
+		}
+	}
+	return changed
+}
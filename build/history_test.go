@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestStripThinking(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages string
+		want     string
+	}{
+		{
+			name:     "earlier turns lose their reasoning",
+			messages: `[{"role":"user","content":"a"},{"role":"assistant","content":"b","reasoning_content":"r","thinking":"t"},{"role":"user","content":"c"}]`,
+			want:     `[{"role":"user","content":"a"},{"role":"assistant","content":"b"},{"role":"user","content":"c"}]`,
+		},
+		{
+			name:     "turn in progress keeps it",
+			messages: `[{"role":"user","content":"a"},{"role":"assistant","content":"","reasoning":"r","tool_calls":[]},{"role":"tool","content":"x"}]`,
+			want:     `[{"role":"user","content":"a"},{"role":"assistant","content":"","reasoning":"r","tool_calls":[]},{"role":"tool","content":"x"}]`,
+		},
+		{
+			name:     "analysis left in the content",
+			messages: `[{"role":"assistant","content":"<|channel|>analysis<|message|>hmm<|end|><|start|>assistant<|channel|>final<|message|>done<|return|>"},{"role":"user","content":"c"}]`,
+			want:     `[{"role":"assistant","content":"done"},{"role":"user","content":"c"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(`{"messages":`+tt.messages+`}`), &raw); err != nil {
+				t.Fatal(err)
+			}
+			changed := stripThinking(raw, false)
+			var want []interface{}
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(raw["messages"], want) {
+				got, _ := json.Marshal(raw["messages"])
+				t.Errorf("messages = %s, want %s", got, tt.want)
+			}
+			if changed != (tt.messages != tt.want) {
+				t.Errorf("stripThinking reported changed = %t", changed)
+			}
+		})
+	}
+}
+
+func TestCleanAssistantHistory(t *testing.T) {
+	const markup = "<|channel|>analysis<|message|>I'll read it.<|end|>" +
+		"<|start|>assistant<|channel|>commentary to=functions.read_file <|constrain|>json<|message|>{\"path\":\"a.go\"}<|call|>"
+	tests := []struct {
+		name   string
+		native bool
+		want   interface{}
+	}{
+		{"openai", false, map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "read_file", "arguments": `{"path":"a.go"}`}}},
+		{"native", true, map[string]interface{}{"function": map[string]interface{}{"name": "read_file", "arguments": map[string]interface{}{"path": "a.go"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := map[string]interface{}{"role": "assistant", "content": markup}
+			raw := map[string]interface{}{"messages": []interface{}{message}}
+			if !cleanAssistantHistory(raw, tt.native) {
+				t.Fatal("cleanAssistantHistory reported no change")
+			}
+			if message["content"] != "" {
+				t.Errorf("content = %q, want it empty", message["content"])
+			}
+			calls, _ := json.Marshal(message["tool_calls"])
+			var got []map[string]interface{}
+			json.Unmarshal(calls, &got)
+			if len(got) != 1 {
+				t.Fatalf("tool_calls = %s, want one call", calls)
+			}
+			delete(got[0], "id")
+			delete(got[0], "index")
+			want, _ := json.Marshal(tt.want)
+			if gotJSON, _ := json.Marshal(got[0]); string(gotJSON) != string(want) {
+				t.Errorf("tool call = %s, want %s", gotJSON, want)
+			}
+		})
+	}
+}
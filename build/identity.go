@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// responseIdentity holds the model and system_fingerprint reported in
+// OpenAI-compatible completions. Strict OpenAI SDKs check that the model
+// matches the request and expect a fingerprint, which Ollama doesn't send.
+type responseIdentity struct {
+	model       string
+	fingerprint string
+}
+
+// newResponseIdentity returns the identity of completions answering r
+func newResponseIdentity(r *http.Request) responseIdentity {
+	return responseIdentity{model: requestedModel(r), fingerprint: systemFingerprint(injectedGrammar(r))}
+}
+
+// fill sets the model and fingerprint of a completion, keeping the values the upstream sent
+func (id responseIdentity) fill(model, fingerprint *string) {
+	if *model == "" {
+		*model = id.model
+	}
+	if *fingerprint == "" {
+		*fingerprint = id.fingerprint
+	}
+}
+
+// systemFingerprint derives a fingerprint from the adapter version and the
+// grammar the request got, so it only changes when either of them does
+func systemFingerprint(grammar string) string {
+	h := sha256.New()
+	h.Write([]byte(version))
+	h.Write([]byte{0})
+	h.Write([]byte(grammar))
+	return "fp_" + hex.EncodeToString(h.Sum(nil)[:5])
+}
+
+// requestedModel returns the model named in the request body, as recorded by the handler
+func requestedModel(r *http.Request) string {
+	model, _ := r.Context().Value(modelContextKey).(string)
+	return model
+}
+
+// injectedGrammar returns the grammar injected into the request, as recorded
+// by the handler, or nothing when the request got none
+func injectedGrammar(r *http.Request) string {
+	grammar, _ := r.Context().Value(grammarContextKey).(string)
+	return grammar
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// inspectHeader asks the adapter to return the rewritten request instead of proxying it
+const inspectHeader = "X-Adapter-Inspect"
+
+// InspectResponse is returned for requests carrying the inspect header
+type InspectResponse struct {
+	UpstreamURL string          `json:"upstream_url"`
+	Decision    rewriteDecision `json:"decision"`
+	Request     json.RawMessage `json:"request,omitempty"`
+	RawRequest  string          `json:"raw_request,omitempty"`
+}
+
+// isInspectRequest reports whether the client asked for inspect mode
+func isInspectRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get(inspectHeader), "true")
+}
+
+// writeInspectResponse describes what would have been sent upstream, without sending it
+func writeInspectResponse(w http.ResponseWriter, r *http.Request, target *url.URL, body []byte, decision rewriteDecision) {
+	path := *r.URL
+	rewriteUpstreamPath(&path, config.StripPrefix, config.TargetPathPrefix)
+	inspect := InspectResponse{
+		UpstreamURL: strings.TrimRight(target.String(), "/") + path.Path,
+		Decision:    decision,
+	}
+	if json.Valid(body) {
+		inspect.Request = body
+	} else {
+		inspect.RawRequest = string(body)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inspect)
+}
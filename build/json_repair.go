@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// jsonExpect is what the JSON scanner expects next inside an object or array
+type jsonExpect int
+
+const (
+	expectValue jsonExpect = iota
+	expectKey
+	expectColon
+	expectComma
+)
+
+// repairJSONSuffix returns the text that completes JSON cut off mid-document,
+// e.g. `"}` for `{"path":"src/ma`. It returns false when the document is already
+// complete or can't be completed by appending text.
+func repairJSONSuffix(s string) (string, bool) {
+	if strings.TrimSpace(s) == "" || json.Valid([]byte(s)) {
+		return "", false
+	}
+
+	var stack []byte // open '{' and '['
+	expect := expectValue
+	inString, escaped, isKey := false, false, false
+	literal := "" // partial true, false, null or number
+
+	// afterValue updates the expectation once a value is complete
+	afterValue := func() {
+		if len(stack) > 0 {
+			expect = expectComma
+		}
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+				if isKey {
+					expect = expectColon
+				} else {
+					afterValue()
+				}
+			}
+			continue
+		}
+		if literal != "" {
+			if strings.IndexByte("truefalsn0123456789+-.eE", c) >= 0 {
+				literal += string(c)
+				continue
+			}
+			literal = ""
+			afterValue()
+		}
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		case c == '{':
+			stack = append(stack, '{')
+			expect = expectKey
+		case c == '[':
+			stack = append(stack, '[')
+			expect = expectValue
+		case c == '}' || c == ']':
+			if len(stack) == 0 {
+				return "", false
+			}
+			stack = stack[:len(stack)-1]
+			afterValue()
+		case c == '"':
+			inString, isKey = true, expect == expectKey
+		case c == ':':
+			expect = expectValue
+		case c == ',':
+			if len(stack) > 0 && stack[len(stack)-1] == '{' {
+				expect = expectKey
+			} else {
+				expect = expectValue
+			}
+		default:
+			literal = string(c)
+		}
+	}
+
+	var suffix strings.Builder
+	switch {
+	case inString:
+		if escaped {
+			suffix.WriteByte('\\')
+		}
+		suffix.WriteByte('"')
+		if isKey {
+			suffix.WriteString(":null")
+		}
+	case literal != "":
+		suffix.WriteString(completeLiteral(literal))
+	case expect == expectKey && len(stack) > 0 && strings.HasSuffix(strings.TrimSpace(s), ","):
+		suffix.WriteString(`"":null`)
+	case expect == expectColon:
+		suffix.WriteString(":null")
+	case expect == expectValue && len(stack) > 0 && !strings.HasSuffix(strings.TrimSpace(s), "["):
+		suffix.WriteString("null")
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i] == '{' {
+			suffix.WriteByte('}')
+		} else {
+			suffix.WriteByte(']')
+		}
+	}
+
+	if !json.Valid([]byte(s + suffix.String())) {
+		return "", false
+	}
+	return suffix.String(), true
+}
+
+// completeLiteral returns the text completing a partial true, false, null or number
+func completeLiteral(literal string) string {
+	for _, word := range []string{"true", "false", "null"} {
+		if strings.HasPrefix(word, literal) {
+			return word[len(literal):]
+		}
+	}
+	switch literal[len(literal)-1] {
+	case '-', '+', '.', 'e', 'E':
+		return "0"
+	}
+	return ""
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRepairJSONSuffix(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		suffix string
+		ok     bool
+	}{
+		{"empty", "", "", false},
+		{"complete", `{"path":"a.go"}`, "", false},
+		{"open object", `{`, `}`, true},
+		{"mid key", `{"pa`, `":null}`, true},
+		{"after key", `{"path"`, `:null}`, true},
+		{"after colon", `{"path":`, `null}`, true},
+		{"mid string", `{"path":"src/ma`, `"}`, true},
+		{"mid escape", `{"path":"a\`, `\"}`, true},
+		{"after comma", `{"path":"a.go",`, `"":null}`, true},
+		{"mid true", `{"recursive":tr`, `ue}`, true},
+		{"mid null", `{"x":n`, `ull}`, true},
+		{"mid number", `{"line":12`, `}`, true},
+		{"number cut at the exponent", `{"ratio":1e`, `0}`, true},
+		{"negative sign", `{"offset":-`, `0}`, true},
+		{"open array", `{"paths":[`, `]}`, true},
+		{"array after comma", `{"paths":["a",`, `null]}`, true},
+		{"nested", `{"edit":{"diff":[{"old":"a","new":"b`, `"}]}}`, true},
+		{"closing too much", `{"a":1}}`, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			suffix, ok := repairJSONSuffix(tt.in)
+			if suffix != tt.suffix || ok != tt.ok {
+				t.Errorf("repairJSONSuffix(%q) = %q, %t, want %q, %t", tt.in, suffix, ok, tt.suffix, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRepairJSONSuffixAtEveryCut(t *testing.T) {
+	const args = `{"path": "src/main.go", "diff": [{"old": "a\"b", "new": "c\\d"}], "line": -12.5e3, "force": true, "base": null, "tags": []}`
+	for cut := 1; cut < len(args); cut++ {
+		s := args[:cut]
+		suffix, ok := repairJSONSuffix(s)
+		if json.Valid([]byte(s)) {
+			if ok {
+				t.Errorf("repairJSONSuffix(%q) = %q for complete JSON", s, suffix)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("repairJSONSuffix(%q) found no repair", s)
+			continue
+		}
+		if !json.Valid([]byte(s + suffix)) {
+			t.Errorf("repairJSONSuffix(%q) = %q, which leaves invalid JSON", s, suffix)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// grammarRequest holds the fields grammar selection needs. Decoding into it
+// skips the messages, which make up nearly all of a large request.
+type grammarRequest struct {
+	Model      string      `json:"model"`
+	Tools      []Tool      `json:"tools,omitempty"`
+	ToolChoice interface{} `json:"tool_choice,omitempty"`
+}
+
+// optionsLayout records where a request body keeps its options.grammar value,
+// as byte offsets into the body
+type optionsLayout struct {
+	// objectEnd is the offset of the closing brace of the request object
+	objectEnd   int
+	objectEmpty bool
+	// optionsStart is the offset right after the opening brace of options, -1 without options
+	optionsStart int
+	optionsEmpty bool
+	// grammarStart and grammarEnd delimit the options.grammar value, -1 without a grammar
+	grammarStart int
+	grammarEnd   int
+}
+
+// scanOptionsLayout walks the top level of a request body and locates its
+// options.grammar value without decoding the rest. It fails for bodies it
+// cannot edit in place: non-objects, non-object options and duplicate keys.
+func scanOptionsLayout(body []byte) (optionsLayout, error) {
+	layout := optionsLayout{optionsStart: -1, grammarStart: -1, grammarEnd: -1}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if err := expectDelim(dec, '{'); err != nil {
+		return layout, err
+	}
+	layout.objectEmpty = !dec.More()
+
+	seen := make(map[string]bool)
+	for dec.More() {
+		key, err := readKey(dec, seen)
+		if err != nil {
+			return layout, err
+		}
+		if key != "options" {
+			if err := skipValue(dec); err != nil {
+				return layout, err
+			}
+			continue
+		}
+		if err := expectDelim(dec, '{'); err != nil {
+			return layout, fmt.Errorf("options: %v", err)
+		}
+		layout.optionsStart = int(dec.InputOffset())
+		layout.optionsEmpty = !dec.More()
+		options := make(map[string]bool)
+		for dec.More() {
+			key, err := readKey(dec, options)
+			if err != nil {
+				return layout, err
+			}
+			if key == "grammar" {
+				layout.grammarStart = valueStart(body, int(dec.InputOffset()))
+			}
+			if err := skipValue(dec); err != nil {
+				return layout, err
+			}
+			if key == "grammar" {
+				layout.grammarEnd = int(dec.InputOffset())
+			}
+		}
+		if err := expectDelim(dec, '}'); err != nil {
+			return layout, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return layout, err
+	}
+	layout.objectEnd = int(dec.InputOffset()) - 1
+	if _, err := dec.Token(); err != io.EOF {
+		return layout, fmt.Errorf("unexpected data after the request object")
+	}
+	return layout, nil
+}
+
+// expectDelim reads the next token and checks that it is the given delimiter
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("expected %q, got %v", want, tok)
+	}
+	return nil
+}
+
+// readKey reads an object key, rejecting keys already seen in the same object
+func readKey(dec *json.Decoder, seen map[string]bool) (string, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+	key, ok := tok.(string)
+	if !ok {
+		return "", fmt.Errorf("expected an object key, got %v", tok)
+	}
+	if seen[key] {
+		return "", fmt.Errorf("duplicate key %q", key)
+	}
+	seen[key] = true
+	return key, nil
+}
+
+// skipValue consumes the next value without keeping it
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// hasOptionsGrammar reports whether the body sets options.grammar. It only
+// walks the bytes, skipping over strings, so it neither allocates nor
+// validates the body. Keys written with escapes are not recognized, which at
+// worst sends the body through the full rewrite.
+func hasOptionsGrammar(body []byte) bool {
+	if !bytes.Contains(body, []byte(`"grammar"`)) {
+		return false
+	}
+	var stack []byte // open '{' and '[', these bodies are shallow
+	prev := byte(0)  // previous structural character
+	optionsNext, inOptions := false, false
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '"':
+			end := stringEnd(body, i+1)
+			if end < 0 {
+				return false
+			}
+			isKey := len(stack) > 0 && stack[len(stack)-1] == '{' && (prev == '{' || prev == ',')
+			key := body[i+1 : end]
+			switch {
+			case !isKey:
+				optionsNext = false
+			case len(stack) == 1:
+				optionsNext = string(key) == "options"
+			case inOptions && len(stack) == 2 && string(key) == "grammar":
+				return true
+			}
+			i = end
+		case '{', '[':
+			if len(stack) == 1 {
+				inOptions = c == '{' && optionsNext
+			}
+			optionsNext = false
+			stack = append(stack, c)
+		case '}', ']':
+			if len(stack) == 0 {
+				return false
+			}
+			stack = stack[:len(stack)-1]
+			if len(stack) == 1 {
+				inOptions = false
+			}
+		case ':':
+		default:
+			if c != ',' {
+				optionsNext = false
+			}
+		}
+		prev = c
+	}
+	return false
+}
+
+// stringEnd returns the offset of the quote closing the string that starts at offset
+func stringEnd(body []byte, offset int) int {
+	for i := offset; i < len(body); i++ {
+		switch body[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// valueStart returns the offset of the value following the key that ends at offset
+func valueStart(body []byte, offset int) int {
+	for offset < len(body) {
+		switch body[offset] {
+		case ' ', '\t', '\r', '\n', ':':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+// spliceGrammar stores grammar in options.grammar by editing the body bytes,
+// replacing a client grammar or adding the key (and options) as needed.
+// Everything else in the body is left exactly as the client sent it.
+func spliceGrammar(body []byte, layout optionsLayout, grammar string) ([]byte, error) {
+	value, err := json.Marshal(grammar)
+	if err != nil {
+		return nil, err
+	}
+
+	var at, end int
+	var insert []byte
+	switch {
+	case layout.grammarStart >= 0:
+		at, end, insert = layout.grammarStart, layout.grammarEnd, value
+	case layout.optionsStart >= 0:
+		at, end = layout.optionsStart, layout.optionsStart
+		insert = append([]byte(`"grammar":`), value...)
+		if !layout.optionsEmpty {
+			insert = append(insert, ',')
+		}
+	default:
+		at, end = layout.objectEnd, layout.objectEnd
+		if !layout.objectEmpty {
+			insert = append(insert, ',')
+		}
+		insert = append(insert, `"options":{"grammar":`...)
+		insert = append(insert, value...)
+		insert = append(insert, '}')
+	}
+
+	out := make([]byte, 0, len(body)-(end-at)+len(insert))
+	out = append(out, body[:at]...)
+	out = append(out, insert...)
+	return append(out, body[end:]...), nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+)
+
+// Overflow policies for requests beyond --max-concurrency (--overflow-policy flag)
+const (
+	overflowQueue  = "queue"
+	overflowReject = "reject"
+)
+
+// concurrencyLimiter caps the number of requests proxied at the same time.
+// Requests over the limit wait for a free slot or are rejected, depending on the policy.
+type concurrencyLimiter struct {
+	slots  chan struct{}
+	queue  chan struct{} // nil when the queue is unbounded
+	policy string
+
+	mu      sync.Mutex
+	waiters slotWaiters // requests waiting in acquirePriority
+	seq     uint64
+}
+
+// limiter is nil when --max-concurrency is not set
+var limiter *concurrencyLimiter
+
+// newConcurrencyLimiter creates a limiter for maxConcurrency requests.
+// maxQueue bounds the requests waiting for a slot, 0 means unbounded.
+func newConcurrencyLimiter(maxConcurrency, maxQueue int, policy string) *concurrencyLimiter {
+	l := &concurrencyLimiter{
+		slots:  make(chan struct{}, maxConcurrency),
+		policy: policy,
+	}
+	if maxQueue > 0 {
+		l.queue = make(chan struct{}, maxQueue)
+	}
+	return l
+}
+
+// acquire takes a slot for a request. It returns false when the request is
+// rejected because the limit is reached and the queue is full or disabled,
+// or when the client gave up while waiting.
+func (l *concurrencyLimiter) acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		inflightRequests.Inc()
+		return true
+	default:
+	}
+	if l.policy == overflowReject {
+		return false
+	}
+
+	if l.queue != nil {
+		select {
+		case l.queue <- struct{}{}:
+			defer func() { <-l.queue }()
+		default:
+			return false
+		}
+	}
+	queuedRequests.Inc()
+	defer queuedRequests.Dec()
+
+	select {
+	case l.slots <- struct{}{}:
+		inflightRequests.Inc()
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// acquirePriority takes a slot for a request like acquire, except that
+// waiting requests get the slots in order of priority, highest first, and in
+// arrival order among equal priorities
+func (l *concurrencyLimiter) acquirePriority(ctx context.Context, priority int) bool {
+	l.mu.Lock()
+	if len(l.waiters) == 0 {
+		select {
+		case l.slots <- struct{}{}:
+			l.mu.Unlock()
+			inflightRequests.Inc()
+			return true
+		default:
+		}
+	}
+	if l.policy == overflowReject {
+		l.mu.Unlock()
+		return false
+	}
+	if l.queue != nil {
+		select {
+		case l.queue <- struct{}{}:
+			defer func() { <-l.queue }()
+		default:
+			l.mu.Unlock()
+			return false
+		}
+	}
+	l.seq++
+	waiter := &slotWaiter{priority: priority, seq: l.seq, ready: make(chan struct{})}
+	heap.Push(&l.waiters, waiter)
+	l.mu.Unlock()
+
+	queuedRequests.Inc()
+	defer queuedRequests.Dec()
+
+	select {
+	case <-waiter.ready:
+		inflightRequests.Inc()
+		return true
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	if waiter.index >= 0 {
+		heap.Remove(&l.waiters, waiter.index)
+		l.mu.Unlock()
+		return false
+	}
+	l.mu.Unlock()
+	// The slot was handed over while the client went away, pass it on
+	inflightRequests.Inc()
+	l.release()
+	return false
+}
+
+// release frees the slot taken by acquire, handing it straight to the first
+// request waiting in acquirePriority, if any
+func (l *concurrencyLimiter) release() {
+	inflightRequests.Dec()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiters) > 0 {
+		close(heap.Pop(&l.waiters).(*slotWaiter).ready)
+		return
+	}
+	<-l.slots
+}
+
+// slotWaiter is a request waiting for a slot in acquirePriority
+type slotWaiter struct {
+	priority int
+	seq      uint64 // arrival order
+	ready    chan struct{}
+	index    int // position in the heap, -1 once the request got a slot
+}
+
+// slotWaiters is a heap of waiting requests, the next to get a slot first
+type slotWaiters []*slotWaiter
+
+func (h slotWaiters) Len() int { return len(h) }
+
+func (h slotWaiters) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h slotWaiters) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *slotWaiters) Push(x interface{}) {
+	w := x.(*slotWaiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *slotWaiters) Pop() interface{} {
+	old := *h
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*h = old[:len(old)-1]
+	return w
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Formats of the per-request access log line (--access-log-format flag)
+const (
+	accessLogText = "text"
+	accessLogJSON = "json"
+)
+
+// accessLogger writes the JSON Lines access log, nil for text access logs
+var accessLogger *slog.Logger
+
+// setupLogging installs the default structured logger for the given level
+func setupLogging(level string) error {
+	var l slog.Level
+	switch strings.ToLower(level) {
+	case "debug":
+		l = slog.LevelDebug
+	case "info", "":
+		l = slog.LevelInfo
+	case "warn", "warning":
+		l = slog.LevelWarn
+	case "error":
+		l = slog.LevelError
+	default:
+		return fmt.Errorf("invalid log level %q (expected debug, info, warn or error)", level)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: l})))
+	return nil
+}
+
+// setupAccessLog selects the access log format: text lines through the
+// default logger, or one JSON object per request for log shippers
+func setupAccessLog(format string) {
+	accessLogger = nil
+	if format == accessLogJSON {
+		accessLogger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	}
+}
+
+// logAccess writes the access log line of a proxied request
+func logAccess(r *http.Request, rec *statusRecorder, model string, grammarInjected bool, elapsed time.Duration) {
+	if accessLogger == nil {
+		requestLogger(r.Context()).Info("proxied request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"model", model,
+			"grammar_injected", grammarInjected,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"latency", elapsed)
+		return
+	}
+	accessLogger.Info("access",
+		"request_id", requestID(r.Context()),
+		"method", r.Method,
+		"path", r.URL.Path,
+		"model", model,
+		"status", rec.status,
+		"bytes", rec.bytes,
+		"duration_ms", float64(elapsed.Microseconds())/1000,
+		"grammar_injected", grammarInjected)
+}
+
+// statusRecorder captures the status code and the number of body bytes written to the client
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader implements http.ResponseWriter
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(p)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher so streamed responses are not buffered
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
@@ -2,14 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
-	"flag"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // nopCloser wraps a bytes.Reader to implement io.ReadCloser
@@ -25,16 +33,13 @@ func (nc *nopCloser) Close() error {
 	return nil
 }
 
-// Environment variables
-var (
-	targetBaseURL = os.Getenv("TARGET_BASE_URL")
-	listenHost    = os.Getenv("TOOL_CALL_ADAPTER_HOST")
-	listenPort    = os.Getenv("TOOL_CALL_ADAPTER_PORT")
+// Grammar injection policies (--grammar-policy flag)
+const (
+	policyFill     = "fill"     // inject only when the client sent no grammar
+	policyOverride = "override" // always replace the client's grammar
+	policyNever    = "never"    // pass requests through untouched
 )
 
-// Grammar file path (can be set via --config flag or environment variable)
-var grammarFilePath string
-
 // ChatCompletionRequest represents the request body for OpenAI-compatible chat completions
 type ChatCompletionRequest struct {
 	Model    string                       `json:"model"`
@@ -52,10 +57,12 @@ type ChatMessage struct {
 	Name    *string `json:"name,omitempty"`
 	ToolCallID string `json:"tool_call_id,omitempty"`
 	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	ReasoningContent string `json:"reasoning_content,omitempty"`
 }
 
 // ToolCall represents a tool call
 type ToolCall struct {
+	Index    int    `json:"index"`
 	ID       string `json:"id"`
 	Type     string `json:"type"`
 	Function struct {
@@ -76,12 +83,13 @@ type Tool struct {
 
 // ChatCompletionResponse represents the response from OpenAI-compatible completions
 type ChatCompletionResponse struct {
-	ID      string       `json:"id"`
-	Object  string       `json:"object"`
-	Created int64        `json:"created"`
-	Model   string       `json:"model"`
-	Choices []Choice     `json:"choices"`
-	Usage   *Usage       `json:"usage,omitempty"`
+	ID                string   `json:"id"`
+	Object            string   `json:"object"`
+	Created           int64    `json:"created"`
+	Model             string   `json:"model"`
+	SystemFingerprint string   `json:"system_fingerprint,omitempty"`
+	Choices           []Choice `json:"choices"`
+	Usage             *Usage   `json:"usage,omitempty"`
 }
 
 // Choice represents a choice in the response
@@ -98,104 +106,681 @@ type Usage struct {
 	TotalTokens      int `json:"total_tokens"`
 }
 
-// loadGrammar loads the Cline grammar from the file
-func loadGrammar() string {
-	grammarPath := grammarFilePath
-	if grammarPath == "" {
-		grammarPath = os.Getenv("GRAMMAR_FILE_PATH")
+// Where the grammar is injected (--inject-key flag)
+const (
+	injectKeyGrammar = "options.grammar"
+	injectKeyFormat  = "format"
+)
+
+// shouldInjectGrammar applies the grammar policy to a request
+func shouldInjectGrammar(policy string, hasGrammar bool) bool {
+	switch policy {
+	case policyOverride:
+		return true
+	case policyNever:
+		return false
+	default:
+		return !hasGrammar
+	}
+}
+
+// rewriteDecision records what rewriteRequestBody decided for a request
+type rewriteDecision struct {
+	Model             string `json:"model,omitempty"`
+	Policy            string `json:"policy"`
+	ClientGrammar     bool   `json:"client_grammar"`
+	Injected          bool   `json:"grammar_injected"`
+	GrammarSource     string `json:"grammar_source,omitempty"`
+	ModelPattern      string `json:"model_pattern,omitempty"`
+	Disabled          bool   `json:"disabled,omitempty"`
+	InjectKey         string `json:"inject_key,omitempty"`
+	NoTools           bool   `json:"no_tools,omitempty"`
+	DisabledByRequest bool   `json:"disabled_by_request,omitempty"`
+	Grammar           string `json:"-"` // the injected grammar, for the system fingerprint
+}
+
+// requestMeta holds the request fields the proxy needs regardless of the API format
+type requestMeta struct {
+	Model  string `json:"model"`
+	Stream *bool  `json:"stream"`
+}
+
+// rewriteRequestBody injects the grammar into a chat completion request body
+// according to the grammar policy. Both the OpenAI-compatible format and
+// Ollama's native /api/chat format are handled, selected by the request path.
+// Only options.grammar is changed, every other field of the body is kept as sent,
+// including top-level sampling parameters the request structs don't know about.
+// It returns the body to forward and the decisions made; Injected is set when
+// the body differs from the original. Bodies that are empty, are not valid JSON
+// or cannot be re-encoded are returned unchanged.
+func rewriteRequestBody(path string, body []byte, override *grammarSelection) ([]byte, rewriteDecision) {
+	decision := rewriteDecision{Policy: config.GrammarPolicy}
+	if len(body) == 0 {
+		return body, decision
+	}
+
+	// A client grammar that the policy keeps means the body is forwarded as is,
+	// which the options alone settle. The substring check may hit message
+	// content, so it only ever leads to the scan, never to an injection.
+	if !shouldInjectGrammar(config.GrammarPolicy, true) && hasOptionsGrammar(body) {
+		decision.ClientGrammar = true
+		return body, decision
+	}
+
+	if config.InjectKey == injectKeyGrammar && config.SystemPrefix == "" {
+		if newBody, ok := spliceRequestBody(body, override, &decision); ok {
+			return newBody, decision
+		}
+	}
+
+	// The typed request is only used to select the grammar
+	var req ChatCompletionRequest
+	if isOllamaNativeChat(path) {
+		var native OllamaChatRequest
+		if err := json.Unmarshal(body, &native); err != nil {
+			return body, decision
+		}
+		req = ChatCompletionRequest{Model: native.Model, Tools: native.Tools}
+	} else if err := json.Unmarshal(body, &req); err != nil {
+		return body, decision
+	}
+
+	raw, err := decodeRawBody(body)
+	if err != nil {
+		return body, decision
+	}
+	if !applyGrammarPolicy(raw, &req, override, &decision) {
+		return body, decision
+	}
+	applySystemPrefix(raw, config.SystemPrefix)
+	return encodeRewrittenBody(body, raw, &decision)
+}
+
+// decodeRawBody decodes a JSON object keeping numbers as written, so re-encoding
+// doesn't change their precision
+func decodeRawBody(body []byte) (map[string]interface{}, error) {
+	var raw map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, fmt.Errorf("request body is not a JSON object")
+	}
+	return raw, nil
+}
+
+// spliceRequestBody injects the grammar into options.grammar by editing the
+// body in place, so large conversations are neither decoded nor re-encoded.
+// It returns false when the body has to go through the generic rewrite.
+func spliceRequestBody(body []byte, override *grammarSelection, decision *rewriteDecision) ([]byte, bool) {
+	layout, err := scanOptionsLayout(body)
+	if err != nil {
+		return nil, false
+	}
+	var g grammarRequest
+	if err := json.Unmarshal(body, &g); err != nil {
+		return nil, false
+	}
+	req := ChatCompletionRequest{Model: g.Model, Tools: g.Tools, ToolChoice: g.ToolChoice}
+
+	selection, ok := decideGrammar(&req, layout.grammarStart >= 0, override, decision)
+	if !ok {
+		return body, true
+	}
+	newBody, err := spliceGrammar(body, layout, selection.Grammar)
+	if err != nil {
+		decision.GrammarSource = ""
+		decision.ModelPattern = ""
+		decision.Grammar = ""
+		return body, true
+	}
+	decision.InjectKey = injectKeyGrammar
+	decision.Injected = true
+	return newBody, true
+}
+
+// applyGrammarPolicy decides whether the request gets the grammar and, if so,
+// stores the selected grammar in the raw request: in options.grammar, or in the
+// top-level format field for JSON schema grammars with --inject-key format.
+func applyGrammarPolicy(raw map[string]interface{}, req *ChatCompletionRequest, override *grammarSelection, decision *rewriteDecision) bool {
+	options, _ := raw["options"].(map[string]interface{})
+	_, clientGrammar := options["grammar"]
+	if _, ok := raw["format"]; ok && config.InjectKey == injectKeyFormat {
+		clientGrammar = true
+	}
+	selection, ok := decideGrammar(req, clientGrammar, override, decision)
+	if !ok {
+		return false
+	}
+	if config.InjectKey == injectKeyFormat && isJSONSchemaGrammar(selection.Grammar) {
+		raw["format"] = json.RawMessage(selection.Grammar)
+		decision.InjectKey = injectKeyFormat
+		return true
+	}
+
+	if options == nil {
+		options = make(map[string]interface{})
+	}
+	options["grammar"] = selection.Grammar
+	raw["options"] = options
+	decision.InjectKey = injectKeyGrammar
+	return true
+}
+
+// decideGrammar applies the injection policy to a request and returns the
+// grammar it gets. A grammar the client selected through a header replaces
+// the selected one.
+func decideGrammar(req *ChatCompletionRequest, clientGrammar bool, override *grammarSelection, decision *rewriteDecision) (grammarSelection, bool) {
+	decision.Model = req.Model
+	decision.ClientGrammar = clientGrammar
+	if pattern, ok := disabledModelPattern(req.Model); ok {
+		decision.Disabled = true
+		decision.ModelPattern = pattern
+		slog.Debug("grammar injection skipped, model disabled", "model", req.Model, "pattern", pattern)
+		return grammarSelection{}, false
 	}
-	if grammarPath == "" {
-		grammarPath = "/app/cline.gbnf"
+	if config.NoInjectOnEmptyTools && len(req.Tools) == 0 {
+		decision.NoTools = true
+		slog.Debug("grammar injection skipped, request has no tools", "model", req.Model)
+		return grammarSelection{}, false
+	}
+	inject := shouldInjectGrammar(config.GrammarPolicy, decision.ClientGrammar)
+	slog.Debug("grammar policy decision", "policy", config.GrammarPolicy, "client_grammar", decision.ClientGrammar, "inject", inject)
+	if !inject {
+		return grammarSelection{}, false
+	}
+
+	var selection grammarSelection
+	if override != nil {
+		selection = *override
+	} else {
+		selection = selectGrammar(req)
 	}
-	
-	data, err := ioutil.ReadFile(grammarPath)
+	decision.GrammarSource = selection.Source
+	decision.ModelPattern = selection.Pattern
+	decision.Grammar = selection.Grammar
+	return selection, true
+}
+
+// encodeRewrittenBody re-encodes the modified request, keeping the original body on failure
+func encodeRewrittenBody(body []byte, req interface{}, decision *rewriteDecision) ([]byte, rewriteDecision) {
+	newBody, err := json.Marshal(req)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: could not read grammar file: %v\n", err)
-		fmt.Fprintf(os.Stderr, "Warning: using embedded grammar\n")
-		return `root ::= analysis? start final .+
-analysis ::= "<|channel|>analysis<|message|>" ( [^<] | "<" [^|] | "<|" [^e] )* "<|end|>"
-start ::= "<|start|>assistant"
-final ::= "<|channel|>final<|message|>"`
+		decision.GrammarSource = ""
+		decision.ModelPattern = ""
+		decision.Grammar = ""
+		return body, *decision
 	}
-	return string(data)
+	decision.Injected = true
+	return newBody, *decision
 }
 
 // handleProxyRequest handles all incoming requests and proxies them to the target
 func handleProxyRequest(w http.ResponseWriter, r *http.Request) {
-	// Parse the target URL
-	targetURL, err := url.Parse(targetBaseURL)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Invalid target URL: %v", err), http.StatusInternalServerError)
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+
+	// With --debug-endpoints the exchange is kept for /debug/last-request
+	var exchange *debugExchange
+	if debugRequests != nil {
+		exchange = &debugExchange{Time: start, RequestID: requestID(r.Context()), Method: r.Method, Path: r.URL.Path}
+		w = &debugRecorder{ResponseWriter: w, exchange: exchange}
+		r = r.WithContext(context.WithValue(r.Context(), debugContextKey, exchange))
+	}
+
+	var model string
+	var grammarInjected bool
+	defer func() {
+		recordRequestMetrics(rec.status, grammarInjected, time.Since(start))
+		logAccess(r, rec, model, grammarInjected, time.Since(start))
+		if exchange != nil {
+			exchange.Model = model
+			exchange.Status = rec.status
+			exchange.DurationMS = time.Since(start).Milliseconds()
+			debugRequests.add(exchange)
+		}
+	}()
+
+	// Paths outside of --passthrough-paths are not exposed through the adapter
+	if !isPassthroughPath(r.URL.Path) {
+		writeAPIError(w, http.StatusNotFound, "not_found", fmt.Sprintf("Path %s is not proxied", r.URL.Path))
 		return
 	}
 
-	// Create reverse proxy
-	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	// Wait for a free slot when the number of concurrent requests is capped.
+	// With --enable-priority-queue that waits until the model is known, its
+	// default priority depends on it.
+	if limiter != nil && !config.EnablePriorityQueue {
+		if !limiter.acquire(r.Context()) {
+			w.Header().Set("Retry-After", "1")
+			writeAPIError(w, http.StatusTooManyRequests, "too_many_requests", "Too many concurrent requests, retry later")
+			return
+		}
+		defer limiter.release()
+	}
 
-	// Modify the request if needed
-	if r.Method == http.MethodPost {
+	// The adapter's upstream key replaces whatever the client sent, otherwise
+	// the client's Authorization header is forwarded untouched
+	if config.UpstreamAPIKey != "" {
+		r.Header.Set("Authorization", "Bearer "+config.UpstreamAPIKey)
+	}
+
+	// Model lists get the grammar-capable models marked
+	if config.ListModels && isModelListRequest(r) {
+		r = r.WithContext(context.WithValue(r.Context(), modelsContextKey, true))
+	}
+
+	// Modify the request if needed. The upstream is picked once the model is known,
+	// so model based balancing can route on it.
+	var up *upstream
+	var key string
+	var cacheRec *cacheRecorder
+	upgrade := isUpgradeRequest(r)
+	if r.Method == http.MethodPost && !upgrade {
+		// The body is buffered for the grammar injection, so its size is bounded
+		if config.MaxBodySize > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, config.MaxBodySize)
+		}
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error reading request body: %v", err), http.StatusBadRequest)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeAPIError(w, http.StatusRequestEntityTooLarge, "request_too_large",
+					fmt.Sprintf("Request body exceeds the limit of %d bytes", tooLarge.Limit))
+				return
+			}
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_body", fmt.Sprintf("Error reading request body: %v", err))
 			return
 		}
 		r.Body.Close()
 		r.Body = &nopCloser{reader: bytes.NewReader(body)}
 
-		// Parse the request body
-		var req ChatCompletionRequest
-		if err := json.Unmarshal(body, &req); err == nil {
-			// Add the grammar to the options if not already present
-			if req.Options == nil {
-				req.Options = make(map[string]interface{})
+		// Only the --inject-paths endpoints are rewritten, other requests
+		// and their responses are proxied untouched
+		inject := isInjectPath(r.URL.Path)
+
+		// Response handling depends on whether the client asked for a stream.
+		// Ollama's native API streams unless told otherwise.
+		var meta requestMeta
+		var stream bool
+		if err := json.Unmarshal(body, &meta); err == nil {
+			model = meta.Model
+			stream = mayStream(r.URL.Path, meta)
+			ctx := r.Context()
+			if inject {
+				ctx = context.WithValue(ctx, transformContextKey, true)
+				ctx = context.WithValue(ctx, modelContextKey, meta.Model)
+			}
+			if stream {
+				ctx = context.WithValue(ctx, streamContextKey, true)
+			}
+			r = r.WithContext(ctx)
+			if stream {
+				allowLongWrite(w, r)
+			}
+		}
+		up = selectUpstream(&ChatCompletionRequest{Model: meta.Model})
+
+		// The overall timeout only applies to non-streaming requests, streams
+		// may legitimately run for a long time
+		if !stream && config.UpstreamTimeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), config.UpstreamTimeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+
+		// Grammars selected by the client are only read from the allowed directories
+		override, err := requestGrammarOverride(r)
+		if errors.Is(err, errGrammarNotAllowed) {
+			writeAPIError(w, http.StatusForbidden, "grammar_not_allowed", err.Error())
+			return
+		} else if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_grammar", err.Error())
+			return
+		}
+
+		// Inject the grammar and run the other request transforms, forwarding
+		// the original body when nothing changed
+		newBody, decision := body, rewriteDecision{Policy: config.GrammarPolicy}
+		if inject && requestDisablesGrammar(r) {
+			decision.DisabledByRequest = true
+			requestLogger(r.Context()).Debug("grammar injection skipped, disabled by request header")
+		} else if inject {
+			newBody, decision = applyRequestTransforms(r.URL.Path, body, override)
+		}
+		if decision.Injected {
+			grammarInjected = true
+			r = r.WithContext(context.WithValue(r.Context(), grammarContextKey, decision.Grammar))
+			requestLogger(r.Context()).Debug("rewritten request body", "body", loggedBody(newBody))
+			if config.ExposeGrammarHeader {
+				w.Header().Set(grammarSourceHeader, decision.GrammarSource)
+			}
+			// A failed request may be retried without the grammar, the other
+			// transforms still apply
+			if config.FallbackNoGrammar && !stream {
+				r = r.WithContext(context.WithValue(r.Context(), fallbackBodyContextKey, fallbackRequestBody(r.URL.Path, body)))
+			}
+		}
+
+		if exchange != nil {
+			exchange.Decision = &decision
+			exchange.RequestBody = debugBody(body)
+			if !bytes.Equal(newBody, body) {
+				exchange.RewrittenBody = debugBody(newBody)
+			}
+		}
+
+		// Inspect requests get the rewritten request back instead of proxying it
+		if isInspectRequest(r) {
+			writeInspectResponse(w, r, up.target, newBody, decision)
+			return
+		}
+
+		// Identical non-streamed completions are answered from the cache, other
+		// endpoints such as /api/pull or /api/delete have side effects
+		if responses != nil && inject && !stream {
+			key = cacheKey(r.URL.Path, model, newBody)
+			if cached, ok := responses.get(key); ok {
+				cached.write(w)
+				return
+			}
+			w.Header().Set(cacheHeader, "MISS")
+			cacheRec = &cacheRecorder{ResponseWriter: w}
+			w = cacheRec
+		}
+
+		// Identical non-streamed completions in flight share one upstream call
+		if flights != nil && inject && !stream {
+			if key == "" {
+				key = cacheKey(r.URL.Path, model, newBody)
 			}
-			if _, hasGrammar := req.Options["grammar"]; !hasGrammar {
-				req.Options["grammar"] = loadGrammar()
-				// Re-encode the modified request body
-				newBody, jsonErr := json.Marshal(req)
-				if jsonErr == nil {
-					r.Body = &nopCloser{reader: bytes.NewReader(newBody)}
-					r.ContentLength = int64(len(newBody))
-					r.Header.Set("Content-Length", fmt.Sprintf("%d", len(newBody)))
+			call, leader := flights.join(key)
+			if leader {
+				if cacheRec == nil {
+					cacheRec = &cacheRecorder{ResponseWriter: w}
+					w = cacheRec
 				}
+				recorded := cacheRec
+				defer func() {
+					flights.finish(key, call, rec.status != 0 && r.Context().Err() == nil, rec.status, w.Header(), recorded.body.Bytes())
+				}()
+			} else if call.wait(r.Context()) {
+				call.write(w)
+				return
+			} else if r.Context().Err() != nil {
+				return
 			}
 		}
+
+		r.Body = &nopCloser{reader: bytes.NewReader(newBody)}
+		r.ContentLength = int64(len(newBody))
+		r.Header.Set("Content-Length", fmt.Sprintf("%d", len(newBody)))
+	}
+
+	if limiter != nil && config.EnablePriorityQueue {
+		priority, err := requestPriority(r, model)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_priority", err.Error())
+			return
+		}
+		if !limiter.acquirePriority(r.Context(), priority) {
+			w.Header().Set("Retry-After", "1")
+			writeAPIError(w, http.StatusTooManyRequests, "too_many_requests", "Too many concurrent requests, retry later")
+			return
+		}
+		defer limiter.release()
 	}
 
 	// Proxy the request
-	proxy.ServeHTTP(w, r)
+	if up == nil {
+		up = selectUpstream(nil)
+	}
+	up.proxy.ServeHTTP(w, r)
+	if upgrade && rec.status == 0 {
+		// The connection was hijacked, the status never went through the recorder
+		rec.status = http.StatusSwitchingProtocols
+	}
+
+	if responses != nil && cacheRec != nil && isTransformRequest(r) && rec.status == http.StatusOK {
+		header := withoutCORS(w.Header())
+		header.Del(cacheHeader)
+		header.Del(requestIDHeader)
+		responses.set(key, header, cacheRec.body.Bytes())
+	}
+}
+
+// proxyHandler wraps handleProxyRequest in the middleware every proxied request goes through
+func proxyHandler() http.HandlerFunc {
+	return withRequestID(withRecovery(withCORS(requireAuth(handleProxyRequest))))
 }
 
 func main() {
-	// Define command-line flags
-	flag.StringVar(&grammarFilePath, "config", "", "Path to grammar file (.gbnf)")
-	flag.Parse()
+	// Resolve the configuration from flags, environment and config file
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	config = cfg
+
+	// Offline grammar check, the server isn't started
+	if config.TestGrammar != "" {
+		os.Exit(runGrammarTest(config.GrammarFile, config.TestGrammar))
+	}
+
+	if err := setupLogging(config.LogLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	setupAccessLog(config.AccessLogFormat)
+
+	// Load the per-model grammar mapping
+	if config.GrammarMap != "" {
+		mapping, err := loadGrammarMap(config.GrammarMap)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not load grammar map: %v\n", err)
+			os.Exit(1)
+		}
+		grammarMap = mapping
+	}
+
+	// List settings are split once here instead of on every request
+	disabledModels = splitList(config.DisableForModels)
+	grammarModels = splitList(config.GrammarModels)
+	grammarDirs = splitList(config.GrammarDirs)
+	passthroughPaths = splitList(config.PassthroughPaths)
+	injectPaths = splitList(config.InjectPaths)
+	corsOrigins = splitList(config.CORSOrigins)
+	disabledTransforms = splitList(config.DisableTransforms)
+	for _, name := range disabledTransforms {
+		if !isTransformName(name) {
+			fmt.Fprintf(os.Stderr, "Error: unknown transform %q (expected one of %s)\n", name, strings.Join(transformNames(), ", "))
+			os.Exit(1)
+		}
+	}
+
+	if modelPriorities, err = parseModelPriorities(config.PriorityModels); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if roleMap, err = parseRoleMap(config.RoleMap); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := loadSystemPrefix(&config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load system prefix: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Load the grammar files into memory once, so requests don't hit the filesystem
+	if err := preloadGrammars(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Poll the grammar files for changes
+	stopWatch := make(chan struct{})
+	defer close(stopWatch)
+	if config.WatchGrammar {
+		go grammars.watch(config.WatchInterval, stopWatch)
+	}
 
-	// Validate environment variables
-	if targetBaseURL == "" {
-		targetBaseURL = "http://ollama:11434/v1"
+	transport, err := newUpstreamTransport()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	upstreamTransport = transport
+	healthzClient.Transport = transport
+	// In mock mode nothing is sent upstream, the health check included
+	if config.Mock {
+		upstreamTransport = &mockTransport{dir: config.MockDir}
+		healthzClient.Transport = upstreamTransport
+	}
+	if config.ColdStartGrace > 0 {
+		upstreamTransport = &coldStartTransport{next: upstreamTransport, grace: config.ColdStartGrace, baseDelay: coldStartBaseDelay}
+	}
+	if config.MaxRetries > 0 {
+		upstreamTransport = &retryTransport{next: upstreamTransport, maxRetries: config.MaxRetries, baseDelay: retryBaseDelay}
 	}
-	if listenHost == "" {
-		listenHost = "0.0.0.0"
+	if config.FallbackNoGrammar {
+		upstreamTransport = &fallbackTransport{next: upstreamTransport}
 	}
-	if listenPort == "" {
-		listenPort = "8000"
+	if config.CacheTTL > 0 {
+		responses = newResponseCache(config.CacheTTL, config.CacheSize)
 	}
+	if config.DedupeRequests {
+		flights = newRequestFlights()
+	}
+	if config.MaxConcurrency > 0 {
+		limiter = newConcurrencyLimiter(config.MaxConcurrency, config.MaxQueue, config.OverflowPolicy)
+	}
+
+	// Build one reverse proxy per target, reused by every request
+	targets, err := parseTargets(config.TargetBaseURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	setupUpstreams(targets, config.Balance)
 
 	// Print configuration
-	fmt.Printf("Starting GPT-OSS Cline Adapter Proxy\n")
-	fmt.Printf("  Target Base URL: %s\n", targetBaseURL)
-	fmt.Printf("  Listening on: %s:%s\n", listenHost, listenPort)
-	fmt.Printf("  Grammar file: %s\n", grammarFilePath)
+	fmt.Printf("Starting GPT-OSS Cline Adapter Proxy %s (commit %s, built %s)\n", version, commit, buildDate)
+	for _, up := range upstreams {
+		fmt.Printf("  Target Base URL: %s\n", up.target)
+	}
+	if len(upstreams) > 1 {
+		fmt.Printf("  Balance: %s\n", config.Balance)
+	}
+	fmt.Printf("  Listening on: %s:%s\n", config.ListenHost, config.ListenPort)
+	if config.Mock {
+		fmt.Printf("  Mock mode: canned responses, the upstream is not used (fixtures: %q)\n", config.MockDir)
+	}
+	if limiter != nil {
+		fmt.Printf("  Max concurrency: %d (overflow: %s, priority queue: %t)\n", config.MaxConcurrency, config.OverflowPolicy, config.EnablePriorityQueue)
+	}
+	fmt.Printf("  Grammar file: %s\n", config.GrammarFile)
+	if config.ToolGrammar != "" {
+		fmt.Printf("  Tool grammar: %s\n", config.ToolGrammar)
+	}
+	if config.ChatGrammar != "" {
+		fmt.Printf("  Chat grammar: %s\n", config.ChatGrammar)
+	}
+	fmt.Printf("  Grammar policy: %s\n", config.GrammarPolicy)
+	fmt.Printf("  Log level: %s\n", config.LogLevel)
+	fmt.Printf("  Upstream timeout: %s (non-streaming only)\n", config.UpstreamTimeout)
+	if config.StreamIdleTimeout > 0 {
+		fmt.Printf("  Stream idle timeout: %s\n", config.StreamIdleTimeout)
+	}
+	fmt.Printf("  Dial timeout: %s\n", config.DialTimeout)
+	fmt.Printf("  Response header timeout: %s\n", config.ResponseHeaderTimeout)
+	fmt.Printf("  Idle connections: %d total, %d per target, timeout %s\n", config.MaxIdleConns, config.MaxIdleConnsPerHost, config.IdleConnTimeout)
+	fmt.Printf("  Max retries: %d\n", config.MaxRetries)
+	fmt.Printf("  Fallback without grammar: %t\n", config.FallbackNoGrammar)
+	fmt.Printf("  Metrics: %t\n", config.Metrics)
+	fmt.Printf("  Upstream API key: %t\n", config.UpstreamAPIKey != "")
+	fmt.Printf("  Client auth token: %t\n", config.AuthToken != "")
+	if config.StripPrefix != "" || config.TargetPathPrefix != "" {
+		fmt.Printf("  Upstream paths: strip %q, prepend %q\n", config.StripPrefix, config.TargetPathPrefix)
+	}
+	if len(corsOrigins) > 0 {
+		fmt.Printf("  CORS origins: %s\n", strings.Join(corsOrigins, ", "))
+	}
+	if len(passthroughPaths) > 0 {
+		fmt.Printf("  Passthrough paths: %s\n", strings.Join(passthroughPaths, ", "))
+	}
+	if config.WatchGrammar {
+		fmt.Printf("  Watching grammar files every %s\n", config.WatchInterval)
+	}
+	if config.DebugEndpoints {
+		fmt.Printf("  Debug endpoints enabled, keeping the last %d requests\n", config.DebugHistory)
+	}
+	if config.GrammarMap != "" {
+		fmt.Printf("  Grammar map: %s (%d entries)\n", config.GrammarMap, len(grammarMap))
+	}
+
+	// Adapter endpoints are registered before the catch-all proxy and only
+	// answer GET and HEAD
+	http.HandleFunc("/healthz", withRecovery(withCORS(withMethods(handleHealthz, adapterEndpointMethods...))))
+	http.HandleFunc("/version", withRecovery(withCORS(withMethods(handleVersion, adapterEndpointMethods...))))
+	if config.Metrics {
+		http.HandleFunc("/metrics", withMethods(promhttp.Handler().ServeHTTP, adapterEndpointMethods...))
+	}
+	// The debug history holds prompts, so it is protected like the proxy
+	if config.DebugEndpoints {
+		debugRequests = newDebugHistory(config.DebugHistory)
+		http.HandleFunc("/debug/last-request", withRecovery(requireAuth(withMethods(handleDebugLastRequest, adapterEndpointMethods...))))
+	}
 
 	// Handle all routes with the proxy
-	http.HandleFunc("/", handleProxyRequest)
+	http.HandleFunc("/", proxyHandler())
 
 	// Start the server
-	addr := fmt.Sprintf("%s:%s", listenHost, listenPort)
-	fmt.Printf("Server starting on %s\n", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	addr := fmt.Sprintf("%s:%s", config.ListenHost, config.ListenPort)
+	srv := newServer(addr)
+	// TLS connections negotiate HTTP/2 through ALPN on their own, cleartext
+	// HTTP/2 has to be accepted explicitly
+	if config.H2C {
+		srv.Handler = h2c.NewHandler(http.DefaultServeMux, &http2.Server{})
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		if config.TLSCert != "" {
+			fmt.Printf("Server starting on %s (TLS)\n", addr)
+			serverErr <- srv.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+			return
+		}
+		if config.H2C {
+			fmt.Printf("Server starting on %s (HTTP/1.1 and h2c)\n", addr)
+		} else {
+			fmt.Printf("Server starting on %s\n", addr)
+		}
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	// Wait for a shutdown signal and let in-flight requests finish
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-serverErr:
 		fmt.Fprintf(os.Stderr, "Server error: %v\n", err)
 		os.Exit(1)
+	case sig := <-stop:
+		fmt.Printf("Received %s, shutting down (timeout %s)\n", sig, config.ShutdownTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Shutdown error: %v\n", err)
+		os.Exit(1)
 	}
+	fmt.Printf("Server stopped\n")
 }
\ No newline at end of file
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordedRequest is a request received by the fake Ollama
+type recordedRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// fakeOllama is an upstream standing in for Ollama that records the requests
+// the adapter forwards. It answers with reply, or with a plain completion
+// when reply is nil.
+type fakeOllama struct {
+	*httptest.Server
+	reply http.HandlerFunc
+
+	mu       sync.Mutex
+	requests []recordedRequest
+}
+
+// fakeCompletion is the default answer of the fake Ollama
+const fakeCompletion = `{"id":"chatcmpl-1","object":"chat.completion","created":1,"model":"gpt-oss:20b",` +
+	`"choices":[{"index":0,"message":{"role":"assistant","content":"<|channel|>final<|message|>Hello<|return|>"},"finish_reason":"stop"}]}`
+
+// newFakeOllama starts a fake Ollama, closed when the test ends
+func newFakeOllama(t *testing.T, reply http.HandlerFunc) *fakeOllama {
+	t.Helper()
+	f := &fakeOllama{reply: reply}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeOllama) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	f.mu.Lock()
+	f.requests = append(f.requests, recordedRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone(), Body: body})
+	f.mu.Unlock()
+
+	if f.reply != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		f.reply(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(fakeCompletion))
+}
+
+// received returns the requests received so far
+func (f *fakeOllama) received() []recordedRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]recordedRequest(nil), f.requests...)
+}
+
+// last returns the last request received, failing the test if there was none
+func (f *fakeOllama) last(t *testing.T) recordedRequest {
+	t.Helper()
+	requests := f.received()
+	if len(requests) == 0 {
+		t.Fatal("the fake Ollama received no request")
+	}
+	return requests[len(requests)-1]
+}
+
+// startAdapter runs the proxy with cfg in front of ollama, stopped when the
+// test ends. The target is ollama's /v1, as with a real Ollama.
+func startAdapter(t *testing.T, cfg Config, ollama *fakeOllama) *httptest.Server {
+	t.Helper()
+	cfg.TargetBaseURL = ollama.URL + "/v1"
+	useConfig(t, cfg)
+
+	saved := struct {
+		transport http.RoundTripper
+		upstreams []*upstream
+		selector  targetSelector
+		responses *responseCache
+		flights   *requestFlights
+	}{upstreamTransport, upstreams, selector, responses, flights}
+	t.Cleanup(func() {
+		upstreamTransport, upstreams, selector = saved.transport, saved.upstreams, saved.selector
+		responses, flights = saved.responses, saved.flights
+	})
+
+	transport, err := newUpstreamTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamTransport = transport
+	if cfg.FallbackNoGrammar {
+		upstreamTransport = &fallbackTransport{next: upstreamTransport}
+	}
+	targets, err := parseTargets(cfg.TargetBaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupUpstreams(targets, cfg.Balance)
+	responses, flights = nil, nil
+	if cfg.CacheTTL > 0 {
+		responses = newResponseCache(cfg.CacheTTL, cfg.CacheSize)
+	}
+	if cfg.DedupeRequests {
+		flights = newRequestFlights()
+	}
+
+	adapter := httptest.NewServer(proxyHandler())
+	t.Cleanup(adapter.Close)
+	return adapter
+}
+
+// post sends a JSON body to the adapter and returns the response and its body
+func post(t *testing.T, adapter *httptest.Server, path, body string) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.Post(adapter.URL+path, "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+// forwardedGrammar decodes options.grammar of a forwarded body
+func forwardedGrammar(t *testing.T, body []byte) (string, bool) {
+	t.Helper()
+	raw, err := decodeRawBody(body)
+	if err != nil {
+		t.Fatalf("forwarded body is not a JSON object: %v\n%s", err, body)
+	}
+	options, _ := raw["options"].(map[string]interface{})
+	grammar, ok := options["grammar"].(string)
+	return grammar, ok
+}
+
+func TestGrammarInjectedWhenAbsent(t *testing.T) {
+	upstream := newFakeOllama(t, nil)
+	adapter := startAdapter(t, testConfig(), upstream)
+
+	resp, _ := post(t, adapter, "/v1/chat/completions", `{"model":"gpt-oss:20b","messages":[{"role":"user","content":"hi"}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %s", resp.Status)
+	}
+	want, err := os.ReadFile("cline.gbnf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := forwardedGrammar(t, upstream.last(t).Body)
+	if !ok {
+		t.Fatalf("no grammar forwarded: %s", upstream.last(t).Body)
+	}
+	if got != string(want) {
+		t.Errorf("forwarded grammar = %q, want the contents of cline.gbnf", got)
+	}
+}
+
+func TestGrammarNotInjectedWhenPresent(t *testing.T) {
+	upstream := newFakeOllama(t, nil)
+	adapter := startAdapter(t, testConfig(), upstream)
+
+	body := `{"model":"gpt-oss:20b","messages":[{"role":"user","content":"hi"}],"options":{"grammar":"root ::= \"x\""}}`
+	post(t, adapter, "/v1/chat/completions", body)
+	if got := upstream.last(t).Body; string(got) != body {
+		t.Errorf("forwarded body = %s, want it as sent: %s", got, body)
+	}
+}
+
+func TestMalformedJSONPassedThrough(t *testing.T) {
+	upstream := newFakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid character"}`))
+	})
+	adapter := startAdapter(t, testConfig(), upstream)
+
+	body := `{"model":"gpt-oss:20b","messages":[`
+	resp, _ := post(t, adapter, "/v1/chat/completions", body)
+	if got := upstream.last(t).Body; string(got) != body {
+		t.Errorf("forwarded body = %q, want it as sent: %q", got, body)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %s, want the upstream's 400", resp.Status)
+	}
+}
+
+func TestGetProxiedUnchanged(t *testing.T) {
+	const models = `{"object":"list","data":[{"id":"gpt-oss:20b","object":"model","created":1,"owned_by":"library"}]}`
+	upstream := newFakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(models))
+	})
+	adapter := startAdapter(t, testConfig(), upstream)
+
+	resp, err := http.Get(adapter.URL + "/models?x=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, _ := ioutil.ReadAll(resp.Body)
+
+	req := upstream.last(t)
+	if req.Method != http.MethodGet || req.Path != "/v1/models" || len(req.Body) != 0 {
+		t.Errorf("forwarded %s %s with body %q, want GET /v1/models without a body", req.Method, req.Path, req.Body)
+	}
+	if string(got) != models {
+		t.Errorf("response = %s, want it unchanged: %s", got, models)
+	}
+}
+
+func TestRewriteRequestBody(t *testing.T) {
+	useConfig(t, testConfig())
+	grammar := loadGrammar("gpt-oss:20b", false).Grammar
+
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		injected bool
+		client   bool
+	}{
+		{name: "empty", path: "/v1/chat/completions", body: ""},
+		{name: "malformed", path: "/v1/chat/completions", body: `{"model":"gpt-oss:20b","messages":[`},
+		{name: "not an object", path: "/v1/chat/completions", body: `["gpt-oss:20b"]`},
+		{name: "null", path: "/v1/chat/completions", body: `null`},
+		{name: "trailing garbage", path: "/v1/chat/completions", body: `{"model":"gpt-oss:20b"} x`},
+		{name: "already has grammar", path: "/v1/chat/completions", body: `{"model":"gpt-oss:20b","options":{"grammar":"root ::= \"x\""}}`, client: true},
+		{name: "native already has grammar", path: "/api/chat", body: `{"model":"gpt-oss:20b","options":{"grammar":"root ::= \"x\""}}`, client: true},
+		{name: "no grammar", path: "/v1/chat/completions", body: `{"model":"gpt-oss:20b","messages":[]}`, injected: true},
+		{name: "grammar key in message content", path: "/v1/chat/completions", body: `{"model":"gpt-oss:20b","messages":[{"role":"user","content":"{\"options\":{\"grammar\":\"x\"}}"}]}`, injected: true},
+		{name: "grammar key outside options", path: "/v1/chat/completions", body: `{"model":"gpt-oss:20b","grammar":"x","messages":[]}`, injected: true},
+		{name: "native no grammar", path: "/api/chat", body: `{"model":"gpt-oss:20b","messages":[],"options":{"num_ctx":8192}}`, injected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, decision := rewriteRequestBody(tt.path, []byte(tt.body), nil)
+			if decision.Injected != tt.injected || decision.ClientGrammar != tt.client {
+				t.Errorf("decision = %+v, want injected %t, client grammar %t", decision, tt.injected, tt.client)
+			}
+			if !tt.injected {
+				if string(got) != tt.body {
+					t.Errorf("body = %q, want it unchanged: %q", got, tt.body)
+				}
+				return
+			}
+			if g, ok := forwardedGrammar(t, got); !ok || g != grammar {
+				t.Errorf("options.grammar = %q, want the default grammar", g)
+			}
+		})
+	}
+}
+
+func TestRewriteRequestBodyKeepsExtraFields(t *testing.T) {
+	const body = `{"model": "gpt-oss:20b", "messages": [{"role": "user", "content": "hi"}],
+		"temperature": 0.2, "top_p": 0.95, "frequency_penalty": 0.5, "seed": 9007199254740993,
+		"response_format": {"type": "text"}, "stream_options": {"include_usage": true}, "x_custom": [1, "two", null],
+		"options": {"num_ctx": 32768, "top_k": 40}}`
+	tests := []struct {
+		name   string
+		prefix string // --system-prefix, which sends the body through the generic rewrite
+	}{
+		{name: "splice"},
+		{name: "generic", prefix: "Use the tools."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.SystemPrefix = tt.prefix
+			useConfig(t, cfg)
+
+			got, decision := rewriteRequestBody("/v1/chat/completions", []byte(body), nil)
+			if !decision.Injected {
+				t.Fatalf("grammar not injected: %+v", decision)
+			}
+			sent, err := decodeRawBody([]byte(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			forwarded, err := decodeRawBody(got)
+			if err != nil {
+				t.Fatalf("invalid body %s: %v", got, err)
+			}
+			options, _ := forwarded["options"].(map[string]interface{})
+			if _, ok := options["grammar"]; !ok {
+				t.Fatalf("options = %v, want the grammar", forwarded["options"])
+			}
+			delete(options, "grammar")
+			if tt.prefix != "" {
+				delete(sent, "messages")
+				delete(forwarded, "messages")
+			}
+			if !reflect.DeepEqual(forwarded, sent) {
+				t.Errorf("fields changed on the way upstream:\n got %v\nwant %v", forwarded, sent)
+			}
+		})
+	}
+}
+
+func TestExtraFieldForwardedUntouched(t *testing.T) {
+	const extra = `{"nested": {"seed": 18446744073709551615, "ratio": 1.50, "text": "é <|x|>"}, "list": [true, null, {}]}`
+	tests := []struct {
+		name  string
+		path  string
+		cfg   func(*Config)
+		exact bool // the body is spliced, so the value keeps its bytes
+	}{
+		{name: "openai", path: "/v1/chat/completions", exact: true},
+		{name: "native", path: "/api/chat", exact: true},
+		{name: "generic rewrite", path: "/v1/chat/completions", cfg: func(c *Config) { c.SystemPrefix = "Use the tools." }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			if tt.cfg != nil {
+				tt.cfg(&cfg)
+			}
+			upstream := newFakeOllama(t, nil)
+			adapter := startAdapter(t, cfg, upstream)
+
+			body := `{"model":"gpt-oss:20b","messages":[{"role":"user","content":"hi"}],"x_adapter_test":` + extra + `}`
+			post(t, adapter, tt.path, body)
+			forwarded := upstream.last(t).Body
+			if _, ok := forwardedGrammar(t, forwarded); !ok {
+				t.Fatalf("no grammar forwarded: %s", forwarded)
+			}
+			var got struct {
+				Extra json.RawMessage `json:"x_adapter_test"`
+			}
+			if err := json.Unmarshal(forwarded, &got); err != nil {
+				t.Fatal(err)
+			}
+			if tt.exact && string(got.Extra) != extra {
+				t.Errorf("x_adapter_test = %s, want %s", got.Extra, extra)
+			}
+			// Re-encoding may reorder keys, never change values
+			gotValue, err := decodeRawBody(got.Extra)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantValue, _ := decodeRawBody([]byte(extra))
+			if !reflect.DeepEqual(gotValue, wantValue) {
+				t.Errorf("x_adapter_test = %s, want %s", got.Extra, extra)
+			}
+		})
+	}
+}
+
+// largeChatBody builds a chat request of about size bytes, a long Cline
+// conversation, with the client's own grammar when grammar is set
+func largeChatBody(size int, grammar bool) []byte {
+	var messages []map[string]string
+	turn := strings.Repeat("Here is the file you asked for, with \"quotes\" and\nnewlines. ", 20)
+	for n := 0; n < size; n += 2 * len(turn) {
+		messages = append(messages,
+			map[string]string{"role": "user", "content": turn},
+			map[string]string{"role": "assistant", "content": turn})
+	}
+	req := map[string]interface{}{"model": "gpt-oss:20b", "messages": messages, "temperature": 0.2,
+		"options": map[string]interface{}{"num_ctx": 32768}}
+	if grammar {
+		req["options"].(map[string]interface{})["grammar"] = `root ::= "x"`
+	}
+	body, _ := json.Marshal(req)
+	return body
+}
+
+// rewriteDecoded injects the grammar by decoding and re-encoding the whole
+// body, the path every request took before the splice
+func rewriteDecoded(body []byte) []byte {
+	var req ChatCompletionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return body
+	}
+	raw, err := decodeRawBody(body)
+	if err != nil {
+		return body
+	}
+	var decision rewriteDecision
+	if !applyGrammarPolicy(raw, &req, nil, &decision) {
+		return body
+	}
+	newBody, _ := encodeRewrittenBody(body, raw, &decision)
+	return newBody
+}
+
+// BenchmarkRewriteLargeBody compares the memory used to inject the grammar
+// into a 200KB request by splicing and by decoding the whole body
+func BenchmarkRewriteLargeBody(b *testing.B) {
+	useConfig(b, testConfig())
+	body := largeChatBody(200<<10, false)
+	b.Run("splice", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			if _, decision := rewriteRequestBody("/v1/chat/completions", body, nil); !decision.Injected {
+				b.Fatal("grammar not injected")
+			}
+		}
+	})
+	b.Run("decode", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			rewriteDecoded(body)
+		}
+	})
+}
+
+// BenchmarkRewriteBodyWithGrammar compares the pre-check that finds the
+// client's options.grammar in the bytes with decoding the body to find it
+func BenchmarkRewriteBodyWithGrammar(b *testing.B) {
+	useConfig(b, testConfig())
+	body := largeChatBody(200<<10, true)
+	b.Run("fast path", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			if _, decision := rewriteRequestBody("/v1/chat/completions", body, nil); !decision.ClientGrammar {
+				b.Fatal("client grammar not found")
+			}
+		}
+	})
+	b.Run("decode", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			raw, err := decodeRawBody(body)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if options, _ := raw["options"].(map[string]interface{}); options["grammar"] == nil {
+				b.Fatal("client grammar not found")
+			}
+		}
+	})
+}
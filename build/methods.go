@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// adapterEndpointMethods are the methods the adapter's own endpoints answer
+var adapterEndpointMethods = []string{http.MethodGet, http.MethodHead}
+
+// withMethods answers requests to one of the adapter's own endpoints with 405
+// and an Allow header unless they use one of the given methods, so e.g. a
+// POST /healthz gets a clear error instead of a health report
+func withMethods(next http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range methods {
+			if r.Method == method {
+				next(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed",
+			fmt.Sprintf("Method %s is not allowed on %s, use %s", r.Method, r.URL.Path, allow))
+	}
+}
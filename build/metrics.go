@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "adapter_requests_total",
+		Help: "Total number of proxied requests.",
+	})
+	grammarInjectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "adapter_grammar_injected_total",
+		Help: "Number of proxied requests that had the grammar injected.",
+	})
+	upstreamErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "adapter_upstream_errors_total",
+		Help: "Number of proxied requests that failed, by status class.",
+	}, []string{"class"})
+	upstreamLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "adapter_upstream_latency_seconds",
+		Help:    "Latency of proxied requests in seconds.",
+		Buckets: []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	})
+	inflightRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "adapter_inflight_requests",
+		Help: "Number of requests currently proxied under --max-concurrency.",
+	})
+	queuedRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "adapter_queued_requests",
+		Help: "Number of requests waiting for a --max-concurrency slot.",
+	})
+)
+
+// recordRequestMetrics updates the metrics for a completed proxied request
+func recordRequestMetrics(status int, grammarInjected bool, latency time.Duration) {
+	requestsTotal.Inc()
+	if grammarInjected {
+		grammarInjectedTotal.Inc()
+	}
+	if status >= 400 {
+		upstreamErrorsTotal.WithLabelValues(fmt.Sprintf("%dxx", status/100)).Inc()
+	}
+	upstreamLatency.Observe(latency.Seconds())
+}
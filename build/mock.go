@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Canned model output of --mock, in harmony format so it goes through the
+// same response transforms as real gpt-oss output. {{tool}} is replaced by the
+// name of the first tool of the request.
+const (
+	mockChatOutput = "<|channel|>analysis<|message|>The user sent a message, answer it briefly.<|end|>" +
+		"<|start|>assistant<|channel|>final<|message|>This is a canned response from the adapter's mock mode.<|return|>"
+	mockToolCallOutput = "<|channel|>analysis<|message|>I should call {{tool}} to make progress.<|end|>" +
+		"<|start|>assistant<|channel|>commentary to=functions.{{tool}} <|constrain|>json<|message|>{\"path\":\".\"}<|call|>"
+)
+
+// Fixture files looked up in --mock-dir, replacing the canned output above
+const (
+	mockChatFixture     = "chat.txt"
+	mockToolCallFixture = "tool_call.txt"
+)
+
+// mockModel is the model listed by --mock and used when a request names none
+const mockModel = "gpt-oss:20b"
+
+// mockToolName is called by the canned tool call when the request has no tools
+const mockToolName = "list_files"
+
+// mockCreated is the fixed creation time of mock completions, keeping them deterministic
+const mockCreated = 1735689600
+
+// mockChunkRunes is how many characters of output each streamed chunk carries
+const mockChunkRunes = 8
+
+// mockTransport answers every upstream request itself with canned responses,
+// so clients can be developed and tested without Ollama or a GPU. Requests
+// still pass through the grammar injection and the response transforms.
+// Requests with tools get a tool call, the others a plain answer.
+type mockTransport struct {
+	dir string // --mock-dir, fixtures found there replace the canned output
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	path := strings.TrimRight(req.URL.Path, "/")
+	switch {
+	case req.Method == http.MethodGet && strings.HasSuffix(path, "/api/tags"):
+		return mockJSON(req, http.StatusOK, map[string]interface{}{
+			"models": []map[string]interface{}{{"name": mockModel, "model": mockModel}},
+		}), nil
+	case req.Method == http.MethodGet && strings.HasSuffix(path, "/models"):
+		return mockJSON(req, http.StatusOK, map[string]interface{}{
+			"object": "list",
+			"data":   []map[string]interface{}{{"id": mockModel, "object": "model", "created": mockCreated, "owned_by": "mock"}},
+		}), nil
+	case req.Method == http.MethodPost && isOllamaNativeChat(path):
+		var chat OllamaChatRequest
+		if err := json.Unmarshal(body, &chat); err != nil {
+			return mockJSON(req, http.StatusBadRequest, ollamaError{Error: err.Error()}), nil
+		}
+		output, err := t.output(chat.Tools)
+		if err != nil {
+			return nil, err
+		}
+		return mockNativeCompletion(req, chat.Model, output, chat.Stream == nil || *chat.Stream), nil
+	case req.Method == http.MethodPost && strings.HasSuffix(path, "/chat/completions"):
+		var chat ChatCompletionRequest
+		if err := json.Unmarshal(body, &chat); err != nil {
+			return mockJSON(req, http.StatusBadRequest, ollamaError{Error: err.Error()}), nil
+		}
+		output, err := t.output(chat.Tools)
+		if err != nil {
+			return nil, err
+		}
+		return mockCompletion(req, chat.Model, output, chat.Stream, len(body)), nil
+	}
+	return mockJSON(req, http.StatusNotFound, ollamaError{Error: fmt.Sprintf("%s %s is not available in mock mode", req.Method, req.URL.Path)}), nil
+}
+
+// output returns the model output for a request, read from --mock-dir when
+// the fixture exists there. Fixtures are read on every request, so tests can
+// swap them without restarting the adapter.
+func (t *mockTransport) output(tools []Tool) (string, error) {
+	fixture, output := mockChatFixture, mockChatOutput
+	tool := mockToolName
+	if len(tools) > 0 {
+		fixture, output = mockToolCallFixture, mockToolCallOutput
+		if tools[0].Function.Name != "" {
+			tool = tools[0].Function.Name
+		}
+	}
+	if t.dir != "" {
+		data, err := os.ReadFile(filepath.Join(t.dir, fixture))
+		switch {
+		case err == nil:
+			output = strings.TrimSuffix(string(data), "\n")
+		case !errors.Is(err, fs.ErrNotExist):
+			return "", fmt.Errorf("reading mock fixture: %v", err)
+		}
+	}
+	return strings.ReplaceAll(output, "{{tool}}", tool), nil
+}
+
+// mockCompletion answers an OpenAI-compatible completion request with the
+// output, as a single completion or as SSE chunks
+func mockCompletion(req *http.Request, model, output string, stream bool, promptSize int) *http.Response {
+	if model == "" {
+		model = mockModel
+	}
+	pieces := splitRunes(output, mockChunkRunes)
+	usage := &Usage{PromptTokens: promptSize / 4, CompletionTokens: len(pieces)}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	stop := "stop"
+
+	if !stream {
+		return mockJSON(req, http.StatusOK, ChatCompletionResponse{
+			ID:      "chatcmpl-mock",
+			Object:  "chat.completion",
+			Created: mockCreated,
+			Model:   model,
+			Choices: []Choice{{Message: ChatMessage{Role: "assistant", Content: output}, FinishReason: &stop}},
+			Usage:   usage,
+		})
+	}
+
+	var out bytes.Buffer
+	writeChunk := func(chunk ChatCompletionChunk) {
+		data, _ := json.Marshal(chunk)
+		out.WriteString("data: ")
+		out.Write(data)
+		out.WriteString("\n\n")
+	}
+	chunk := ChatCompletionChunk{ID: "chatcmpl-mock", Object: "chat.completion.chunk", Created: mockCreated, Model: model}
+	for i, piece := range pieces {
+		delta := ChatDelta{Content: piece}
+		if i == 0 {
+			delta.Role = "assistant"
+		}
+		chunk.Choices = []ChunkChoice{{Delta: delta}}
+		writeChunk(chunk)
+	}
+	chunk.Choices = []ChunkChoice{{FinishReason: &stop}}
+	writeChunk(chunk)
+	chunk.Choices, chunk.Usage = []ChunkChoice{}, usage
+	writeChunk(chunk)
+	out.WriteString("data: [DONE]\n\n")
+	return mockBody(req, http.StatusOK, "text/event-stream", out.Bytes())
+}
+
+// mockNativeCompletion answers a native /api/chat request the way Ollama does
+// for gpt-oss, with the harmony output already split into content, thinking
+// and tool calls. Streams get the message and the final done line.
+func mockNativeCompletion(req *http.Request, model, output string, stream bool) *http.Response {
+	if model == "" {
+		model = mockModel
+	}
+	message := map[string]interface{}{"role": "assistant"}
+	content, calls := parseHarmonyResponse(output, "")
+	message["content"] = content
+	if thinking := parseHarmonyReasoning(output); thinking != "" {
+		message["thinking"] = thinking
+	}
+	if len(calls) > 0 {
+		message["tool_calls"] = historyToolCalls(calls, true)
+	}
+	createdAt := time.Unix(mockCreated, 0).UTC().Format(time.RFC3339)
+
+	if !stream {
+		return mockJSON(req, http.StatusOK, map[string]interface{}{
+			"model": model, "created_at": createdAt, "message": message, "done": true, "done_reason": "stop",
+		})
+	}
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.Encode(map[string]interface{}{"model": model, "created_at": createdAt, "message": message, "done": false})
+	enc.Encode(map[string]interface{}{
+		"model": model, "created_at": createdAt, "message": map[string]interface{}{"role": "assistant", "content": ""},
+		"done": true, "done_reason": "stop",
+	})
+	return mockBody(req, http.StatusOK, "application/x-ndjson", out.Bytes())
+}
+
+// mockJSON builds a JSON response to req
+func mockJSON(req *http.Request, status int, v interface{}) *http.Response {
+	data, _ := json.Marshal(v)
+	return mockBody(req, status, "application/json; charset=utf-8", data)
+}
+
+// mockBody builds a response to req with the given body
+func mockBody(req *http.Request, status int, contentType string, body []byte) *http.Response {
+	header := make(http.Header)
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// splitRunes cuts s into pieces of at most n characters, never splitting a character
+func splitRunes(s string, n int) []string {
+	runes := []rune(s)
+	pieces := make([]string, 0, len(runes)/n+1)
+	for len(runes) > n {
+		pieces = append(pieces, string(runes[:n]))
+		runes = runes[n:]
+	}
+	if len(runes) > 0 {
+		pieces = append(pieces, string(runes))
+	}
+	return pieces
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// modelGrammarField marks models in list responses that the adapter injects a grammar for
+const modelGrammarField = "x-adapter-grammar"
+
+// grammarModels are the --grammar-models patterns (split once at startup)
+var grammarModels []string
+
+// isModelListRequest reports whether the request lists models, via the
+// OpenAI-compatible /models or Ollama's native /api/tags endpoint
+func isModelListRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	p := strings.TrimRight(r.URL.Path, "/")
+	return strings.HasSuffix(p, "/models") || strings.HasSuffix(p, "/api/tags")
+}
+
+// isGrammarModel reports whether a model matches one of the --grammar-models patterns
+func isGrammarModel(model string) bool {
+	for _, pattern := range grammarModels {
+		if matchModelPattern(pattern, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// annotateModelsResponse adds x-adapter-grammar to every model of a model list
+// response. Models are listed in "data" (OpenAI) or "models" (Ollama) and all
+// other fields are kept as they are.
+func annotateModelsResponse(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	if ok, err := decodeResponseBody(resp); !ok || err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading upstream response: %v", err)
+	}
+	resp.Body.Close()
+	resp.Body = &nopCloser{reader: bytes.NewReader(body)}
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+
+	var list map[string]interface{}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil
+	}
+	for _, key := range []string{"data", "models"} {
+		models, _ := list[key].([]interface{})
+		for _, m := range models {
+			model, ok := m.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, _ := model["id"].(string)
+			if name == "" {
+				name, _ = model["name"].(string)
+			}
+			model[modelGrammarField] = isGrammarModel(name)
+		}
+	}
+
+	newBody, err := json.Marshal(list)
+	if err != nil {
+		return nil
+	}
+	resp.Body = &nopCloser{reader: bytes.NewReader(newBody)}
+	resp.ContentLength = int64(len(newBody))
+	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(newBody)))
+	return nil
+}
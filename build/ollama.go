@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+)
+
+// OllamaChatRequest represents the request body for Ollama's native /api/chat endpoint
+type OllamaChatRequest struct {
+	Model     string                 `json:"model"`
+	Messages  []OllamaMessage        `json:"messages"`
+	Tools     []Tool                 `json:"tools,omitempty"`
+	Format    interface{}            `json:"format,omitempty"`
+	Options   map[string]interface{} `json:"options,omitempty"`
+	Stream    *bool                  `json:"stream,omitempty"`
+	KeepAlive interface{}            `json:"keep_alive,omitempty"`
+	Think     interface{}            `json:"think,omitempty"`
+}
+
+// OllamaMessage represents a message in Ollama's native chat format
+type OllamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Thinking  string           `json:"thinking,omitempty"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+// OllamaToolCall represents a tool call in Ollama's native chat format,
+// where the arguments are a JSON object rather than an encoded string
+type OllamaToolCall struct {
+	Function struct {
+		Name      string                 `json:"name"`
+		Arguments map[string]interface{} `json:"arguments"`
+	} `json:"function"`
+}
+
+// isOllamaNativeAPI reports whether the request path targets one of Ollama's native /api endpoints
+func isOllamaNativeAPI(path string) bool {
+	return strings.Contains(path, "/api/")
+}
+
+// isOllamaNativeChat reports whether the request path targets Ollama's native chat endpoint
+func isOllamaNativeChat(path string) bool {
+	return strings.HasSuffix(strings.TrimRight(path, "/"), "/api/chat")
+}
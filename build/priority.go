@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// priorityHeader sets the priority of a request in the --enable-priority-queue queue
+const priorityHeader = "X-Adapter-Priority"
+
+// Named priorities accepted by the priority header besides integers
+var namedPriorities = map[string]int{
+	"interactive": 10,
+	"normal":      0,
+	"batch":       -10,
+}
+
+// modelPriority is a --priority-models entry
+type modelPriority struct {
+	pattern  string
+	priority int
+}
+
+// modelPriorities is the parsed --priority-models, in the order given
+var modelPriorities []modelPriority
+
+// parseModelPriorities parses a comma-separated list of pattern=priority pairs
+func parseModelPriorities(s string) ([]modelPriority, error) {
+	var priorities []modelPriority
+	for _, pair := range splitList(s) {
+		pattern, value, ok := strings.Cut(pair, "=")
+		pattern = strings.TrimSpace(pattern)
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid model priority %q, expected pattern=priority", pair)
+		}
+		priority, err := parsePriority(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid model priority %q: %v", pair, err)
+		}
+		priorities = append(priorities, modelPriority{pattern: pattern, priority: priority})
+	}
+	return priorities, nil
+}
+
+// parsePriority parses an integer or named priority
+func parsePriority(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if priority, ok := namedPriorities[strings.ToLower(s)]; ok {
+		return priority, nil
+	}
+	priority, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an integer or one of interactive, normal, batch", s)
+	}
+	return priority, nil
+}
+
+// requestPriority returns the queue priority of a request: the priority
+// header if set, else the first --priority-models entry matching the model,
+// else 0. Higher priorities get upstream slots first.
+func requestPriority(r *http.Request, model string) (int, error) {
+	if value := r.Header.Get(priorityHeader); value != "" {
+		priority, err := parsePriority(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s header: %v", priorityHeader, err)
+		}
+		return priority, nil
+	}
+	for _, mp := range modelPriorities {
+		if matchModelPattern(mp.pattern, model) {
+			return mp.priority, nil
+		}
+	}
+	return 0, nil
+}
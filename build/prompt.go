@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// loadSystemPrefix reads the --system-prefix-file, if any, into the configured prefix
+func loadSystemPrefix(cfg *Config) error {
+	if cfg.SystemPrefixFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(cfg.SystemPrefixFile)
+	if err != nil {
+		return err
+	}
+	cfg.SystemPrefix = strings.TrimSpace(string(data))
+	return nil
+}
+
+// applySystemPrefix prepends the --system-prefix to the request's system message,
+// or adds a system message when the conversation doesn't start with one
+func applySystemPrefix(raw map[string]interface{}, prefix string) {
+	if prefix == "" {
+		return
+	}
+	messages, ok := raw["messages"].([]interface{})
+	if !ok {
+		return
+	}
+
+	if len(messages) > 0 {
+		if first, ok := messages[0].(map[string]interface{}); ok && first["role"] == "system" {
+			switch content := first["content"].(type) {
+			case string:
+				first["content"] = prefix + "\n\n" + content
+				return
+			case []interface{}:
+				part := map[string]interface{}{"type": "text", "text": prefix}
+				first["content"] = append([]interface{}{part}, content...)
+				return
+			}
+		}
+	}
+
+	system := map[string]interface{}{"role": "system", "content": prefix}
+	raw["messages"] = append([]interface{}{system}, messages...)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// withRecovery turns a panic in the handler into a 500 error for the one
+// request that caused it, logged with its stack trace and request ID. A
+// response already under way can't be replaced, it is cut off instead.
+func withRecovery(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// The reverse proxy panics with ErrAbortHandler to drop a
+			// connection on purpose, the server handles that quietly
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			requestLogger(r.Context()).Error("panic while handling request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", fmt.Sprint(v),
+				"stack", string(debug.Stack()))
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			writeAPIError(rec, http.StatusInternalServerError, "internal_error", "Internal error while handling the request")
+		}()
+		next(rec, r)
+	}
+}
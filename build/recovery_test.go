@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// panicTrigger in a request body makes the panicking transforms panic
+const panicTrigger = "panic-please"
+
+// panicRequestTransform panics on request bodies holding panicTrigger
+type panicRequestTransform struct{}
+
+func (panicRequestTransform) Name() string { return "panic-request" }
+
+func (panicRequestTransform) TransformRequest(state *requestTransformState) {
+	if bytes.Contains(state.Body, []byte(panicTrigger)) {
+		var state *requestTransformState
+		state.Body = nil // nil dereference, like a bug in a transform
+	}
+}
+
+// panicResponseTransform panics on responses to requests sent with X-Test-Panic
+type panicResponseTransform struct{}
+
+func (panicResponseTransform) Name() string { return "panic-response" }
+
+func (panicResponseTransform) Applies(resp *http.Response) bool {
+	return resp.Request.Header.Get("X-Test-Panic") != ""
+}
+
+func (panicResponseTransform) TransformResponse(resp *http.Response) error {
+	panic("transform bug")
+}
+
+func TestTransformPanicReturns500(t *testing.T) {
+	savedRequest, savedResponse := requestTransforms, responseTransforms
+	t.Cleanup(func() { requestTransforms, responseTransforms = savedRequest, savedResponse })
+	requestTransforms = append([]RequestTransform{panicRequestTransform{}}, requestTransforms...)
+	responseTransforms = append([]ResponseTransform{panicResponseTransform{}}, responseTransforms...)
+
+	upstream := newFakeOllama(t, nil)
+	adapter := startAdapter(t, testConfig(), upstream)
+	logs := captureLogs(t)
+	const ok = `{"model":"gpt-oss:20b","messages":[{"role":"user","content":"hi"}]}`
+
+	tests := []struct {
+		name   string
+		body   string
+		header string
+	}{
+		{name: "request transform", body: `{"model":"gpt-oss:20b","messages":[{"role":"user","content":"` + panicTrigger + `"}]}`},
+		{name: "response transform", body: ok, header: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, adapter.URL+"/v1/chat/completions", bytes.NewBufferString(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if tt.header != "" {
+				req.Header.Set("X-Test-Panic", tt.header)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed instead of getting a 500: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusInternalServerError {
+				t.Errorf("status = %s, want 500", resp.Status)
+			}
+			var got APIErrorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil || got.Error.Type != "server_error" {
+				t.Errorf("body = %+v, %v, want an OpenAI server_error", got, err)
+			}
+
+			if !strings.Contains(logs.String(), "panic while handling request") || !strings.Contains(logs.String(), "request_id=") {
+				t.Errorf("panic not logged with the request ID:\n%s", logs)
+			}
+			logs.Reset()
+
+			// The server is still up for the next request
+			if resp, body := post(t, adapter, "/v1/chat/completions", ok); resp.StatusCode != http.StatusOK {
+				t.Errorf("next request: status = %s, body %s", resp.Status, body)
+			}
+		})
+	}
+}
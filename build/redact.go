@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// redactedFields are the JSON fields that carry prompt or completion text
+var redactedFields = map[string]bool{
+	"content":           true,
+	"reasoning_content": true,
+	"thinking":          true,
+	"text":              true,
+	"arguments":         true,
+	"prompt":            true,
+}
+
+// loggedBody returns a request or response body for logging. With --log-redact
+// the text of messages, tool results and tool arguments is replaced by its length
+// and hash, while model, roles, tool names and the other fields stay readable.
+func loggedBody(body []byte) string {
+	if !config.LogRedact {
+		return string(body)
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return redactString(string(body))
+	}
+	out, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return redactString(string(body))
+	}
+	return string(out)
+}
+
+// redactValue walks a decoded JSON value and redacts the text fields. A text
+// field is redacted as a whole whatever its type, e.g. native tool call
+// arguments sent as an object or content sent as an array of parts.
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if !redactedFields[key] || value == nil {
+				v[key] = redactValue(value)
+				continue
+			}
+			s, ok := value.(string)
+			if !ok {
+				encoded, _ := json.Marshal(value)
+				s = string(encoded)
+			}
+			v[key] = redactString(s)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	}
+	return v
+}
+
+// redactString replaces a string by its length and a short hash, so equal
+// prompts can still be recognized in the logs
+func redactString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return fmt.Sprintf("[redacted len=%d sha256=%s]", len(s), hex.EncodeToString(sum[:6]))
+}
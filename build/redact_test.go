@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoggedBodyRedactsWholeValues(t *testing.T) {
+	cfg := testConfig()
+	cfg.LogRedact = true
+	useConfig(t, cfg)
+
+	tests := []struct {
+		name    string
+		body    string
+		secrets []string // text that must not be logged
+		kept    []string // text that must stay readable
+	}{
+		{
+			name:    "string content",
+			body:    `{"model":"gpt-oss:20b","messages":[{"role":"user","content":"my secret"}]}`,
+			secrets: []string{"my secret"},
+			kept:    []string{`"model":"gpt-oss:20b"`, `"role":"user"`},
+		},
+		{
+			name:    "native arguments object",
+			body:    `{"message":{"role":"assistant","tool_calls":[{"function":{"name":"read_file","arguments":{"path":"/etc/secret"}}}]}}`,
+			secrets: []string{"/etc/secret", `"path"`},
+			kept:    []string{`"name":"read_file"`},
+		},
+		{
+			name:    "content parts",
+			body:    `{"messages":[{"role":"user","content":[{"type":"text","text":"hidden"},{"type":"image_url","image_url":{"url":"data:x"}}]}]}`,
+			secrets: []string{"hidden", "data:x"},
+			kept:    []string{`"role":"user"`},
+		},
+		{
+			name:    "numeric prompt",
+			body:    `{"prompt":12345}`,
+			secrets: []string{"12345"},
+		},
+		{
+			name: "null content",
+			body: `{"role":"assistant","content":null}`,
+			kept: []string{`"content":null`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := loggedBody([]byte(tt.body))
+			for _, secret := range tt.secrets {
+				if strings.Contains(got, secret) {
+					t.Errorf("loggedBody leaked %q: %s", secret, got)
+				}
+			}
+			for _, kept := range tt.kept {
+				if !strings.Contains(got, kept) {
+					t.Errorf("loggedBody lost %q: %s", kept, got)
+				}
+			}
+		})
+	}
+}
+
+func TestLoggedBodyRedactsInvalidJSON(t *testing.T) {
+	cfg := testConfig()
+	cfg.LogRedact = true
+	useConfig(t, cfg)
+	if got := loggedBody([]byte("not json: secret")); strings.Contains(got, "secret") {
+		t.Errorf("loggedBody leaked invalid body: %s", got)
+	}
+}
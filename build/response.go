@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// gzipReadCloser closes both the gzip reader and the underlying body
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+// Close implements io.Closer
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
+// decodeResponseBody replaces a gzip encoded response body with its decompressed
+// stream and drops the encoding headers accordingly. It returns false when the
+// body uses an encoding the adapter cannot transform.
+func decodeResponseBody(resp *http.Response) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return true, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return false, fmt.Errorf("decompressing upstream response: %v", err)
+		}
+		resp.Body = &gzipReadCloser{Reader: zr, body: resp.Body}
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// modifyResponse applies the response transforms to every upstream response
+func modifyResponse(resp *http.Response) error {
+	// The client gets the adapter's request ID, which the upstream may echo as well
+	resp.Header.Del(requestIDHeader)
+	stripUpstreamCORS(resp.Header)
+	captureUpstreamBody(resp)
+
+	return applyResponseTransforms(resp)
+}
+
+// filterStreamResponse installs the harmony filter on streamed (SSE) responses
+func filterStreamResponse(resp *http.Response) error {
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return nil
+	}
+	if ok, err := decodeResponseBody(resp); !ok || err != nil {
+		return err
+	}
+	resp.Body = newHarmonyStreamFilter(resp.Body, newResponseIdentity(resp.Request))
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	return nil
+}
+
+// harmonyFinishReason returns the finish reason of a rewritten message:
+// "tool_calls" when it calls tools, "stop" for a plain final message the
+// upstream gave no (or a tool call) reason for, and the upstream's reason otherwise
+func harmonyFinishReason(upstream *string, msg *ChatMessage) *string {
+	reason := ""
+	switch {
+	case len(msg.ToolCalls) > 0:
+		reason = "tool_calls"
+	case msg.Content != "" && (upstream == nil || *upstream == "" || *upstream == "tool_calls"):
+		reason = "stop"
+	default:
+		return upstream
+	}
+	return &reason
+}
+
+// rewriteHarmonyResponse converts harmony formatted completions into clean
+// OpenAI messages, moving tool calls into Choice.Message.ToolCalls
+func rewriteHarmonyResponse(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	if ok, err := decodeResponseBody(resp); !ok || err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading upstream response: %v", err)
+	}
+	resp.Body.Close()
+
+	// The body is sent decompressed from here on, even if it is left untouched
+	resp.Body = &nopCloser{reader: bytes.NewReader(body)}
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+
+	var completion ChatCompletionResponse
+	if err := json.Unmarshal(body, &completion); err != nil || len(completion.Choices) == 0 {
+		return nil
+	}
+
+	newResponseIdentity(resp.Request).fill(&completion.Model, &completion.SystemFingerprint)
+	for i := range completion.Choices {
+		msg := &completion.Choices[i].Message
+		if reasoning := parseHarmonyReasoning(msg.Content); reasoning != "" {
+			msg.ReasoningContent = truncateAnalysis(reasoning, config.MaxAnalysisChars)
+		}
+		content, calls := parseHarmonyResponse(msg.Content, toolCallScope(completion.ID, completion.Choices[i].Index))
+		msg.Content = content
+		msg.ToolCalls = append(msg.ToolCalls, calls...)
+		// Calls parsed from the text follow the ones the upstream returned itself
+		for j := range msg.ToolCalls {
+			msg.ToolCalls[j].Index = j
+		}
+		var dropped int
+		if msg.ToolCalls, dropped = limitToolCalls(msg.ToolCalls, config.MaxToolCalls); dropped > 0 {
+			requestLogger(resp.Request.Context()).Warn("dropped tool calls beyond --max-tool-calls",
+				"choice", completion.Choices[i].Index,
+				"kept", len(msg.ToolCalls),
+				"dropped", dropped)
+		}
+		completion.Choices[i].FinishReason = harmonyFinishReason(completion.Choices[i].FinishReason, msg)
+	}
+
+	newBody, err := json.Marshal(completion)
+	if err != nil {
+		return nil
+	}
+	requestLogger(resp.Request.Context()).Debug("rewritten response body", "body", loggedBody(newBody))
+	resp.Body = &nopCloser{reader: bytes.NewReader(newBody)}
+	resp.ContentLength = int64(len(newBody))
+	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(newBody)))
+	return nil
+}
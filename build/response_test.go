@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// rewriteCompletion runs a completion body through rewriteHarmonyResponse and
+// decodes the result
+func rewriteCompletion(t *testing.T, completion string) ChatCompletionResponse {
+	t.Helper()
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(completion)),
+		Request:    httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil),
+	}
+	if err := rewriteHarmonyResponse(resp); err != nil {
+		t.Fatal(err)
+	}
+	var rewritten ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rewritten); err != nil {
+		t.Fatal(err)
+	}
+	return rewritten
+}
+
+func TestHarmonyFinishReason(t *testing.T) {
+	useConfig(t, testConfig())
+	const (
+		call  = "<|channel|>commentary to=functions.read_file <|constrain|>json<|message|>{\"path\":\"a.go\"}<|call|>"
+		final = "<|channel|>final<|message|>Done.<|return|>"
+	)
+	tests := []struct {
+		name     string
+		content  string
+		upstream string // finish_reason sent by the upstream as JSON
+		want     string
+	}{
+		{"tool call", call, `"stop"`, "tool_calls"},
+		{"tool call cut off", call, `"length"`, "tool_calls"},
+		{"final message", final, `"stop"`, "stop"},
+		{"final message without a reason", final, `null`, "stop"},
+		{"final message the upstream took for a call", final, `"tool_calls"`, "stop"},
+		{"final message cut off", final, `"length"`, "length"},
+		{"nothing left", "<|channel|>analysis<|message|>Hmm", `"length"`, "length"},
+		{"plain text", "Hello", `"stop"`, "stop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			completion := fmt.Sprintf(`{"id":"chatcmpl-1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":%q},"finish_reason":%s}]}`,
+				tt.content, tt.upstream)
+			got := rewriteCompletion(t, completion).Choices[0].FinishReason
+			if got == nil || *got != tt.want {
+				t.Errorf("finish_reason = %v, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteHarmonyResponseEveryChoice(t *testing.T) {
+	useConfig(t, testConfig())
+	const call = "<|channel|>analysis<|message|>Read it.<|end|><|start|>assistant<|channel|>commentary to=functions.read_file <|constrain|>json<|message|>{\"path\":\"a.go\"}<|call|>"
+	completion := fmt.Sprintf(`{"id":"chatcmpl-2","object":"chat.completion","choices":[`+
+		`{"index":0,"message":{"role":"assistant","content":%q},"finish_reason":"stop"},`+
+		`{"index":1,"message":{"role":"assistant","content":%q},"finish_reason":"stop"},`+
+		`{"index":2,"message":{"role":"assistant","content":%q},"finish_reason":"stop"}]}`,
+		"<|channel|>analysis<|message|>Easy.<|end|><|start|>assistant<|channel|>final<|message|>Hello<|return|>", call, call)
+
+	choices := rewriteCompletion(t, completion).Choices
+	if len(choices) != 3 {
+		t.Fatalf("got %d choices, want 3", len(choices))
+	}
+	if msg := choices[0].Message; msg.Content != "Hello" || msg.ReasoningContent != "Easy." || len(msg.ToolCalls) != 0 {
+		t.Errorf("choice 0 = %+v, want the final text and its reasoning", msg)
+	}
+	if r := choices[0].FinishReason; r == nil || *r != "stop" {
+		t.Errorf("choice 0 finish_reason = %v, want stop", r)
+	}
+	for _, i := range []int{1, 2} {
+		msg := choices[i].Message
+		if msg.Content != "" || msg.ReasoningContent != "Read it." || len(msg.ToolCalls) != 1 {
+			t.Fatalf("choice %d = %+v, want one tool call and its reasoning", i, msg)
+		}
+		if c := msg.ToolCalls[0]; c.Function.Name != "read_file" || c.Function.Arguments != `{"path":"a.go"}` {
+			t.Errorf("choice %d tool call = %s(%s)", i, c.Function.Name, c.Function.Arguments)
+		}
+		if r := choices[i].FinishReason; r == nil || *r != "tool_calls" {
+			t.Errorf("choice %d finish_reason = %v, want tool_calls", i, r)
+		}
+	}
+	if choices[1].Message.ToolCalls[0].ID == choices[2].Message.ToolCalls[0].ID {
+		t.Errorf("the same call in two choices got the same ID %s", choices[1].Message.ToolCalls[0].ID)
+	}
+}
+
+func TestHarmonyStreamEveryChoice(t *testing.T) {
+	useConfig(t, testConfig())
+	content := []string{
+		"<|channel|>final<|message|>Hel",
+		"<|channel|>commentary to=functions.read_file <|constrain|>json<|message|>{\"path\"",
+		"lo<|return|>",
+		":\"a.go\"}<|call|>",
+	}
+	var sse strings.Builder
+	for i, piece := range content {
+		fmt.Fprintf(&sse, "data: {\"id\":\"chatcmpl-3\",\"object\":\"chat.completion.chunk\",\"choices\":[{\"index\":%d,\"delta\":{\"content\":%q}}]}\n\n", i%2, piece)
+	}
+	sse.WriteString("data: {\"id\":\"chatcmpl-3\",\"object\":\"chat.completion.chunk\",\"choices\":[" +
+		"{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"},{\"index\":1,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n")
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	out, err := ioutil.ReadAll(newHarmonyStreamFilter(ioutil.NopCloser(strings.NewReader(sse.String())), newResponseIdentity(req)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := map[int]string{}
+	args := map[int]string{}
+	finish := map[int]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		data := strings.TrimPrefix(line, "data: ")
+		if data == line || data == "[DONE]" {
+			continue
+		}
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		for _, c := range chunk.Choices {
+			text[c.Index] += c.Delta.Content
+			for _, d := range c.Delta.ToolCalls {
+				args[c.Index] += d.Function.Arguments
+			}
+			if c.FinishReason != nil {
+				finish[c.Index] = *c.FinishReason
+			}
+		}
+	}
+	if text[0] != "Hello" || args[0] != "" || finish[0] != "stop" {
+		t.Errorf("choice 0: content %q, arguments %q, finish_reason %q; want Hello and stop", text[0], args[0], finish[0])
+	}
+	if text[1] != "" || args[1] != `{"path":"a.go"}` || finish[1] != "tool_calls" {
+		t.Errorf("choice 1: content %q, arguments %q, finish_reason %q; want the call and tool_calls", text[1], args[1], finish[1])
+	}
+}
+
+// The fingerprint follows the grammar the request actually got, so a grammar
+// selected through a header changes it
+func TestSystemFingerprintFollowsInjectedGrammar(t *testing.T) {
+	upstream := newFakeOllama(t, nil)
+	adapter := startAdapter(t, testConfig(), upstream)
+
+	send := func(inline string) string {
+		body := `{"model":"gpt-oss:20b","messages":[{"role":"user","content":"hi"}]}`
+		req, _ := http.NewRequest(http.MethodPost, adapter.URL+"/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if inline != "" {
+			req.Header.Set(grammarInlineHeader, base64.StdEncoding.EncodeToString([]byte(inline)))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var completion ChatCompletionResponse
+		if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+			t.Fatal(err)
+		}
+		grammar, _ := forwardedGrammar(t, upstream.last(t).Body)
+		if want := systemFingerprint(grammar); completion.SystemFingerprint != want {
+			t.Errorf("system_fingerprint = %q, want %q from the forwarded grammar", completion.SystemFingerprint, want)
+		}
+		return completion.SystemFingerprint
+	}
+
+	if send("") == send(`root ::= "a"`) {
+		t.Error("a grammar selected through a header did not change the fingerprint")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// defaultRoleMap sends the developer role of newer OpenAI clients as a system
+// message, which every model template understands. Ollama's gpt-oss template
+// renders system messages as harmony developer instructions anyway.
+const defaultRoleMap = "developer=system"
+
+// harmonyRoles are the roles messages can be mapped to
+var harmonyRoles = []string{"system", "developer", "user", "assistant", "tool"}
+
+// roleMap is the parsed --role-map, from client role to the role sent upstream
+var roleMap map[string]string
+
+// parseRoleMap parses a comma-separated list of from=to role pairs
+func parseRoleMap(s string) (map[string]string, error) {
+	roles := make(map[string]string)
+	for _, pair := range splitList(s) {
+		from, to, ok := strings.Cut(pair, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid role mapping %q, expected from=to", pair)
+		}
+		if !isHarmonyRole(to) {
+			return nil, fmt.Errorf("invalid role mapping %q, %q is not one of %s", pair, to, strings.Join(harmonyRoles, ", "))
+		}
+		if from != to {
+			roles[from] = to
+		}
+	}
+	return roles, nil
+}
+
+// isHarmonyRole reports whether role is one of harmonyRoles
+func isHarmonyRole(role string) bool {
+	for _, r := range harmonyRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// mayNeedRoleMap reports whether the body may hold a message with a mapped
+// role. A miss means no message needs mapping, a hit has to be checked on the
+// decoded messages.
+func mayNeedRoleMap(body []byte, roles map[string]string) bool {
+	for from := range roles {
+		if bytes.Contains(body, []byte(`"`+from+`"`)) {
+			return true
+		}
+	}
+	return false
+}
+
+// roleMapTransform applies --role-map to the messages of every request,
+// whether or not it gets the grammar
+type roleMapTransform struct{}
+
+func (roleMapTransform) Name() string { return "roles" }
+
+func (roleMapTransform) TransformRequest(state *requestTransformState) {
+	if !mayNeedRoleMap(state.Body, roleMap) {
+		return
+	}
+	if raw, ok := state.decoded(); ok && applyRoleMap(raw, roleMap) {
+		state.changed()
+	}
+}
+
+// applyRoleMap replaces the roles of the request's messages according to
+// roles. It reports whether any message was changed.
+func applyRoleMap(raw map[string]interface{}, roles map[string]string) bool {
+	if len(roles) == 0 {
+		return false
+	}
+	messages, ok := raw["messages"].([]interface{})
+	if !ok {
+		return false
+	}
+	changed := false
+	for _, m := range messages {
+		message, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if role, ok := message["role"].(string); ok {
+			if to, ok := roles[role]; ok {
+				message["role"] = to
+				changed = true
+			}
+		}
+	}
+	return changed
+}
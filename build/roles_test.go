@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRoleMap(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{in: "", want: map[string]string{}},
+		{in: "developer=system", want: map[string]string{"developer": "system"}},
+		{in: " system = developer , function=tool", want: map[string]string{"system": "developer", "function": "tool"}},
+		{in: "user=user", want: map[string]string{}},
+		{in: "developer", wantErr: true},
+		{in: "developer=", wantErr: true},
+		{in: "developer=root", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRoleMap(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRoleMap(%q) error = %v, want error %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseRoleMap(%q) = %v, want %v", tt.in, got, tt.want)
+			continue
+		}
+		for from, to := range tt.want {
+			if got[from] != to {
+				t.Errorf("parseRoleMap(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		}
+	}
+}
+
+// The role map applies whether or not the request gets the grammar
+func TestRoleMapIndependentOfGrammar(t *testing.T) {
+	const developer = `{"role":"developer","content":"Be brief."}`
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		body      string
+		injected  bool
+	}{
+		{
+			name:     "grammar injected",
+			body:     `{"model":"gpt-oss:20b","messages":[` + developer + `],"tools":[{"type":"function","function":{"name":"f"}}]}`,
+			injected: true,
+		},
+		{
+			name: "client grammar kept",
+			body: `{"model":"gpt-oss:20b","messages":[` + developer + `],"options":{"grammar":"root ::= \"x\""}}`,
+		},
+		{
+			name:      "model disabled",
+			configure: func(cfg *Config) { cfg.DisableForModels = "gpt-oss*" },
+			body:      `{"model":"gpt-oss:20b","messages":[` + developer + `]}`,
+		},
+		{
+			name:      "no tools",
+			configure: func(cfg *Config) { cfg.NoInjectOnEmptyTools = true },
+			body:      `{"model":"gpt-oss:20b","messages":[` + developer + `]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			if tt.configure != nil {
+				tt.configure(&cfg)
+			}
+			useConfig(t, cfg)
+
+			body, decision := applyRequestTransforms("/v1/chat/completions", []byte(tt.body), nil)
+			if decision.Injected != tt.injected {
+				t.Errorf("grammar injected = %t, want %t", decision.Injected, tt.injected)
+			}
+			if !strings.Contains(string(body), `"role":"system"`) || strings.Contains(string(body), `"developer"`) {
+				t.Errorf("developer role not mapped: %s", body)
+			}
+		})
+	}
+}
+
+func TestRoleMapLeavesOtherRequestsAlone(t *testing.T) {
+	cfg := testConfig()
+	cfg.DisableTransforms = "grammar"
+	useConfig(t, cfg)
+	body := []byte(`{"model":"llama3","messages":[{"role":"user","content":"hi"}]}`)
+	if got, _ := applyRequestTransforms("/v1/chat/completions", body, nil); string(got) != string(body) {
+		t.Errorf("body changed without a mapped role: %s", got)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// newServer creates the adapter's HTTP server. The read timeouts and header
+// limit keep slow or oversized requests from tying up connections, the write
+// timeout bounds non-streamed responses; streams lift it, see allowLongWrite.
+func newServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+}
+
+// allowLongWrite lifts --write-timeout for a response that may stream for a
+// long time. Writers that can't change their deadline keep it, with a warning.
+func allowLongWrite(w http.ResponseWriter, r *http.Request) {
+	if config.WriteTimeout <= 0 {
+		return
+	}
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		requestLogger(r.Context()).Warn("could not lift the write timeout of a streamed response",
+			"write_timeout", config.WriteTimeout,
+			"error", err)
+	}
+}
+
+// mayStream reports whether the response to a request can be a stream:
+// streamed completions, and Ollama's native endpoints, which stream unless
+// told otherwise (pulling a model can take far longer than any write timeout)
+func mayStream(path string, meta requestMeta) bool {
+	if meta.Stream != nil {
+		return *meta.Stream
+	}
+	return isOllamaNativeAPI(path)
+}
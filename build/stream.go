@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ChatCompletionChunk represents a single streamed chunk of an OpenAI-compatible chat completion
+type ChatCompletionChunk struct {
+	ID                string        `json:"id"`
+	Object            string        `json:"object"`
+	Created           int64         `json:"created"`
+	Model             string        `json:"model"`
+	SystemFingerprint string        `json:"system_fingerprint,omitempty"`
+	Choices           []ChunkChoice `json:"choices"`
+	Usage             *Usage        `json:"usage,omitempty"`
+}
+
+// ChunkChoice represents a choice in a streamed chunk
+type ChunkChoice struct {
+	Index        int       `json:"index"`
+	Delta        ChatDelta `json:"delta"`
+	FinishReason *string   `json:"finish_reason"`
+}
+
+// ChatDelta represents the incremental message content of a streamed choice
+type ChatDelta struct {
+	Role             string          `json:"role,omitempty"`
+	Content          string          `json:"content,omitempty"`
+	ReasoningContent string          `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCallDelta `json:"tool_calls,omitempty"`
+}
+
+// ToolCallDelta is a piece of a streamed tool call. The first delta of a call
+// carries its ID and function name, the following ones only argument text.
+type ToolCallDelta struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// streamChoice is the harmony parsing state of one streamed choice
+type streamChoice struct {
+	parser    harmonyParser
+	call      *harmonyHeader  // header of the tool call being streamed, if any
+	callIndex int             // index of the current tool call
+	numCalls  int             // number of tool calls started so far
+	analysis  int             // analysis characters sent so far
+	truncated bool            // analysis exceeded --max-analysis-chars
+	args      strings.Builder // arguments sent for the current tool call
+	callOpen  bool            // the current tool call's arguments haven't been checked yet
+	repaired  bool            // arguments were completed because the stream was cut off
+	finished  bool            // a finish reason was sent
+	finals    int             // final channel messages with text that ended
+	inFinal   bool            // text of the current final channel message was sent
+	scope     string          // toolCallScope of the choice, for tool call IDs
+}
+
+// finishCall checks the arguments of the current tool call and returns the
+// delta completing them when the stream was cut off mid JSON, if any
+func (sc *streamChoice) finishCall() []ToolCallDelta {
+	if !sc.callOpen {
+		return nil
+	}
+	sc.callOpen = false
+	suffix, ok := repairJSONSuffix(sc.args.String())
+	if !ok {
+		return nil
+	}
+	sc.repaired = true
+	sc.args.WriteString(suffix)
+	var d ToolCallDelta
+	d.Index = sc.callIndex
+	d.Function.Arguments = suffix
+	return []ToolCallDelta{d}
+}
+
+// mergeToolCallDeltas appends deltas, joining argument text sent for the same call
+func mergeToolCallDeltas(deltas, more []ToolCallDelta) []ToolCallDelta {
+	for _, d := range more {
+		if n := len(deltas); n > 0 && deltas[n-1].Index == d.Index && d.ID == "" {
+			deltas[n-1].Function.Arguments += d.Function.Arguments
+			continue
+		}
+		deltas = append(deltas, d)
+	}
+	return deltas
+}
+
+// finishReason returns the finish reason to report for the choice
+func (sc *streamChoice) finishReason(upstream string) string {
+	switch {
+	case sc.repaired:
+		return "length"
+	case sc.numCalls > 0:
+		return "tool_calls"
+	default:
+		return upstream
+	}
+}
+
+// finalText returns the text of a final channel chunk. Text already sent
+// can't be taken back, so a stream with several final channel messages always
+// joins them, separated by --final-separator.
+func (sc *streamChoice) finalText(c harmonyChunk) string {
+	text := c.Text
+	if strings.TrimSpace(text) != "" {
+		if !sc.inFinal && sc.finals > 0 {
+			text = config.FinalSeparator + text
+		}
+		sc.inFinal = true
+	}
+	if c.End && sc.inFinal {
+		sc.finals++
+		sc.inFinal = false
+	}
+	return text
+}
+
+// limitAnalysis applies --max-analysis-chars to the next piece of analysis text
+func (sc *streamChoice) limitAnalysis(text string, max int) string {
+	if max <= 0 || text == "" {
+		return text
+	}
+	if sc.truncated {
+		return ""
+	}
+	remaining := max - sc.analysis
+	if remaining <= 0 {
+		sc.truncated = true
+		return analysisEllipsis
+	}
+	limited := truncateAnalysis(text, remaining)
+	if limited != text {
+		sc.truncated = true
+	}
+	sc.analysis += utf8.RuneCountInString(text)
+	return limited
+}
+
+// toolCallDeltas turns the parsed chunks addressed to functions.NAME into tool call
+// deltas and returns the remaining chunks
+func (sc *streamChoice) toolCallDeltas(chunks []harmonyChunk) ([]ToolCallDelta, []harmonyChunk) {
+	var deltas []ToolCallDelta
+	var rest []harmonyChunk
+	for _, c := range chunks {
+		if !strings.HasPrefix(c.Header.Recipient, "functions.") {
+			rest = append(rest, c)
+			continue
+		}
+		if sc.call == nil || *sc.call != c.Header {
+			deltas = append(deltas, sc.finishCall()...)
+			header := c.Header
+			sc.call = &header
+			sc.callIndex = sc.numCalls
+			sc.numCalls++
+
+			var d ToolCallDelta
+			d.Index = sc.callIndex
+			d.Type = "function"
+			d.Function.Name = strings.TrimPrefix(c.Header.Recipient, "functions.")
+			d.ID = makeToolCallID(sc.scope, d.Function.Name, d.Index)
+			deltas = append(deltas, d)
+			sc.args.Reset()
+			sc.callOpen = true
+		}
+		if c.Text != "" {
+			sc.args.WriteString(c.Text)
+			if n := len(deltas); n > 0 && deltas[n-1].Index == sc.callIndex {
+				deltas[n-1].Function.Arguments += c.Text
+			} else {
+				var d ToolCallDelta
+				d.Index = sc.callIndex
+				d.Function.Arguments = c.Text
+				deltas = append(deltas, d)
+			}
+		}
+		if c.End {
+			sc.call = nil
+		}
+	}
+	return deltas, rest
+}
+
+// harmonyStreamFilter rewrites an upstream SSE stream so that harmony control
+// tokens are removed: final channel text is emitted as delta.content, analysis
+// channel text as delta.reasoning_content and calls to functions.NAME as
+// delta.tool_calls. Events are forwarded one at a time.
+type harmonyStreamFilter struct {
+	src      *bufio.Reader
+	closer   io.Closer
+	choices  map[int]*streamChoice
+	last     ChatCompletionChunk // identifies the stream in synthesized chunks
+	identity responseIdentity
+	out      bytes.Buffer
+	event    bytes.Buffer
+	usage    streamUsage
+	err      error
+	ended    bool
+}
+
+// newHarmonyStreamFilter wraps an upstream SSE response body
+func newHarmonyStreamFilter(body io.ReadCloser, identity responseIdentity) *harmonyStreamFilter {
+	return &harmonyStreamFilter{
+		src:      bufio.NewReader(body),
+		closer:   body,
+		choices:  make(map[int]*streamChoice),
+		identity: identity,
+	}
+}
+
+// Read implements io.Reader
+func (f *harmonyStreamFilter) Read(p []byte) (int, error) {
+	for f.out.Len() == 0 && f.err == nil {
+		f.readEvent()
+	}
+	if f.out.Len() > 0 {
+		return f.out.Read(p)
+	}
+	return 0, f.err
+}
+
+// Close implements io.Closer
+func (f *harmonyStreamFilter) Close() error {
+	return f.closer.Close()
+}
+
+// readEvent reads lines from upstream until a complete SSE event has been
+// collected, then writes the rewritten event to the output buffer
+func (f *harmonyStreamFilter) readEvent() {
+	line, err := f.src.ReadBytes('\n')
+	if len(line) > 0 {
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			f.writeEvent()
+		} else {
+			f.event.Write(line)
+		}
+	}
+	if err != nil {
+		if f.event.Len() > 0 {
+			f.writeEvent()
+		}
+		f.writeCutOffCalls()
+		f.writeUsage()
+		f.err = err
+	}
+}
+
+// writeEvent rewrites the collected event and appends it to the output buffer.
+// Events that carry nothing after the rewrite are dropped.
+func (f *harmonyStreamFilter) writeEvent() {
+	defer f.event.Reset()
+
+	var data []byte
+	var other bytes.Buffer
+	for _, line := range bytes.SplitAfter(f.event.Bytes(), []byte("\n")) {
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if bytes.HasPrefix(trimmed, []byte("data:")) {
+			data = append(data, bytes.TrimPrefix(bytes.TrimPrefix(trimmed, []byte("data:")), []byte(" "))...)
+		} else if len(trimmed) > 0 {
+			other.Write(line)
+		}
+	}
+
+	if string(data) == "[DONE]" {
+		f.writeCutOffCalls()
+		f.writeUsage()
+	}
+	if data == nil || string(data) == "[DONE]" {
+		f.out.Write(f.event.Bytes())
+		f.out.WriteString("\n")
+		return
+	}
+
+	rewritten, keep := f.rewriteChunk(data)
+	if !keep {
+		return
+	}
+	f.out.Write(other.Bytes())
+	f.out.WriteString("data: ")
+	f.out.Write(rewritten)
+	f.out.WriteString("\n\n")
+}
+
+// writeCutOffCalls finishes tool calls of choices that never received a finish
+// reason, for streams that were cut off mid call. Arguments left as incomplete
+// JSON are completed, so clients can always parse them.
+func (f *harmonyStreamFilter) writeCutOffCalls() {
+	if f.ended {
+		return
+	}
+	f.ended = true
+
+	indexes := make([]int, 0, len(f.choices))
+	for index, sc := range f.choices {
+		if !sc.finished && sc.numCalls > 0 {
+			indexes = append(indexes, index)
+		}
+	}
+	if len(indexes) == 0 {
+		return
+	}
+	sort.Ints(indexes)
+
+	chunk := ChatCompletionChunk{ID: f.last.ID, Object: f.last.Object, Created: f.last.Created, Model: f.last.Model,
+		SystemFingerprint: f.last.SystemFingerprint}
+	for _, index := range indexes {
+		sc := f.choices[index]
+		deltas, _ := sc.toolCallDeltas(sc.parser.flush())
+		deltas = mergeToolCallDeltas(deltas, sc.finishCall())
+		finish := sc.finishReason("stop")
+		sc.finished = true
+		chunk.Choices = append(chunk.Choices, ChunkChoice{
+			Index:        index,
+			Delta:        ChatDelta{ToolCalls: deltas},
+			FinishReason: &finish,
+		})
+	}
+	out, err := json.Marshal(chunk)
+	if err != nil {
+		return
+	}
+	f.out.WriteString("data: ")
+	f.out.Write(out)
+	f.out.WriteString("\n\n")
+}
+
+// rewriteChunk strips harmony markup from a single chunk payload.
+// It returns false when the chunk no longer carries anything worth sending.
+func (f *harmonyStreamFilter) rewriteChunk(data []byte) ([]byte, bool) {
+	var chunk ChatCompletionChunk
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		// Not a chunk we understand, forward it untouched
+		return data, true
+	}
+	f.identity.fill(&chunk.Model, &chunk.SystemFingerprint)
+	f.last = chunk
+	f.usage.addChunk(&chunk)
+	if config.StreamUsage {
+		// Reported once, in the consolidated frame before [DONE]
+		chunk.Usage = nil
+	}
+
+	keep := chunk.Usage != nil
+	for i := range chunk.Choices {
+		choice := &chunk.Choices[i]
+		sc, ok := f.choices[choice.Index]
+		if !ok {
+			sc = &streamChoice{scope: toolCallScope(chunk.ID, choice.Index)}
+			f.choices[choice.Index] = sc
+		}
+
+		chunks := sc.parser.feed(choice.Delta.Content)
+		if choice.FinishReason != nil {
+			chunks = append(chunks, sc.parser.flush()...)
+		}
+		deltas, chunks := sc.toolCallDeltas(chunks)
+		if choice.FinishReason != nil {
+			deltas = mergeToolCallDeltas(deltas, sc.finishCall())
+			finish := sc.finishReason(*choice.FinishReason)
+			choice.FinishReason = &finish
+			sc.finished = true
+		}
+		choice.Delta.ToolCalls = append(choice.Delta.ToolCalls, deltas...)
+
+		var content, reasoning strings.Builder
+		for _, c := range chunks {
+			switch c.Header.Channel {
+			case channelFinal:
+				content.WriteString(sc.finalText(c))
+			case "":
+				content.WriteString(c.Text)
+			case channelAnalysis:
+				reasoning.WriteString(c.Text)
+			}
+		}
+		choice.Delta.Content = content.String()
+		choice.Delta.ReasoningContent = sc.limitAnalysis(reasoning.String(), config.MaxAnalysisChars)
+
+		if choice.Delta.Role != "" || choice.Delta.Content != "" || choice.Delta.ReasoningContent != "" ||
+			len(choice.Delta.ToolCalls) > 0 || choice.FinishReason != nil {
+			keep = true
+		}
+	}
+	if !keep {
+		return nil, false
+	}
+
+	out, err := json.Marshal(chunk)
+	if err != nil {
+		return data, true
+	}
+	return out, true
+}
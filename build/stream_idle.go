@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// errStreamIdle is returned when the upstream sent nothing for --stream-idle-timeout
+var errStreamIdle = errors.New("upstream stream idle timeout")
+
+// idleTimeoutReader closes an upstream body that stays silent for longer than
+// the timeout. Only time spent waiting for the upstream counts, a slow client
+// never trips the timeout.
+type idleTimeoutReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	fired   atomic.Bool
+}
+
+// newIdleTimeoutReader wraps an upstream response body
+func newIdleTimeoutReader(body io.ReadCloser, timeout time.Duration) *idleTimeoutReader {
+	r := &idleTimeoutReader{body: body, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		r.fired.Store(true)
+		r.body.Close()
+	})
+	r.timer.Stop()
+	return r
+}
+
+// Read implements io.Reader
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	n, err := r.body.Read(p)
+	r.timer.Stop()
+	if err != nil && r.fired.Load() {
+		return n, errStreamIdle
+	}
+	return n, err
+}
+
+// Close implements io.Closer
+func (r *idleTimeoutReader) Close() error {
+	r.timer.Stop()
+	return r.body.Close()
+}
+
+// idleErrorReader ends a stream cut off by the idle timeout with an error
+// frame, so the client sees why the stream ended instead of a dropped connection
+type idleErrorReader struct {
+	io.ReadCloser
+	frame []byte
+	tail  *bytes.Reader
+	req   *http.Request
+}
+
+// Read implements io.Reader
+func (r *idleErrorReader) Read(p []byte) (int, error) {
+	if r.tail != nil {
+		return r.tail.Read(p)
+	}
+	n, err := r.ReadCloser.Read(p)
+	if errors.Is(err, errStreamIdle) {
+		requestLogger(r.req.Context()).Warn("upstream stream idle, closing it",
+			"path", r.req.URL.Path,
+			"timeout", config.StreamIdleTimeout)
+		r.tail = bytes.NewReader(r.frame)
+		err = nil
+	}
+	return n, err
+}
+
+// streamIdleFrame returns the error frame for a stream in the response's format:
+// an SSE event with an OpenAI error, or an Ollama error line for NDJSON streams
+func streamIdleFrame(resp *http.Response, timeout time.Duration) []byte {
+	message := fmt.Sprintf("No data received from the upstream for %s", timeout)
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		data, _ := json.Marshal(APIErrorResponse{Error: APIError{
+			Message: message,
+			Type:    apiErrorType(http.StatusGatewayTimeout),
+			Code:    "stream_idle_timeout",
+		}})
+		return []byte("data: " + string(data) + "\n\n")
+	}
+	data, _ := json.Marshal(ollamaError{Error: message})
+	return append(data, '\n')
+}
+
+// filterStreamWithIdleTimeout applies the stream filter to a streamed response,
+// bounding the time the upstream may stay silent with --stream-idle-timeout
+func filterStreamWithIdleTimeout(resp *http.Response) error {
+	timeout := config.StreamIdleTimeout
+	if timeout <= 0 {
+		return filterStreamResponse(resp)
+	}
+	resp.Body = newIdleTimeoutReader(resp.Body, timeout)
+	if err := filterStreamResponse(resp); err != nil {
+		return err
+	}
+	resp.Body = &idleErrorReader{ReadCloser: resp.Body, frame: streamIdleFrame(resp, timeout), req: resp.Request}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// recordedToolCallStream is a gpt-oss stream as Ollama sends it, with the
+// harmony tokens of a tool call split across chunks
+const recordedToolCallStream = `data: {"id":"chatcmpl-412","object":"chat.completion.chunk","created":1760400000,"model":"gpt-oss:20b","system_fingerprint":"fp_ollama","choices":[{"index":0,"delta":{"role":"assistant","content":"<|chan"},"finish_reason":null}]}
+
+data: {"id":"chatcmpl-412","object":"chat.completion.chunk","created":1760400000,"model":"gpt-oss:20b","system_fingerprint":"fp_ollama","choices":[{"index":0,"delta":{"role":"assistant","content":"nel|>analysis<|message|>Need to read"},"finish_reason":null}]}
+
+data: {"id":"chatcmpl-412","object":"chat.completion.chunk","created":1760400000,"model":"gpt-oss:20b","system_fingerprint":"fp_ollama","choices":[{"index":0,"delta":{"role":"assistant","content":" the file.<|end|><|start|>assistant<|channel|>commentary to=functions.read_file <|constrain|>json<|mess"},"finish_reason":null}]}
+
+data: {"id":"chatcmpl-412","object":"chat.completion.chunk","created":1760400000,"model":"gpt-oss:20b","system_fingerprint":"fp_ollama","choices":[{"index":0,"delta":{"role":"assistant","content":"age|>{\"path\":"},"finish_reason":null}]}
+
+data: {"id":"chatcmpl-412","object":"chat.completion.chunk","created":1760400000,"model":"gpt-oss:20b","system_fingerprint":"fp_ollama","choices":[{"index":0,"delta":{"role":"assistant","content":" \"main.go\"}<|"},"finish_reason":null}]}
+
+data: {"id":"chatcmpl-412","object":"chat.completion.chunk","created":1760400000,"model":"gpt-oss:20b","system_fingerprint":"fp_ollama","choices":[{"index":0,"delta":{"role":"assistant","content":"call|>"},"finish_reason":null}]}
+
+data: {"id":"chatcmpl-412","object":"chat.completion.chunk","created":1760400000,"model":"gpt-oss:20b","system_fingerprint":"fp_ollama","choices":[{"index":0,"delta":{"role":"assistant","content":""},"finish_reason":"stop"}]}
+
+data: [DONE]
+
+`
+
+// sseTranscript builds a stream whose content arrives in the given pieces,
+// ending with the finish reason unless it is empty, as for a cut-off stream
+func sseTranscript(finish string, pieces ...string) string {
+	var sse strings.Builder
+	for _, piece := range pieces {
+		fmt.Fprintf(&sse, "data: {\"id\":\"chatcmpl-9\",\"object\":\"chat.completion.chunk\",\"model\":\"gpt-oss:20b\",\"choices\":[{\"index\":0,\"delta\":{\"content\":%q},\"finish_reason\":null}]}\n\n", piece)
+	}
+	if finish != "" {
+		fmt.Fprintf(&sse, "data: {\"id\":\"chatcmpl-9\",\"object\":\"chat.completion.chunk\",\"model\":\"gpt-oss:20b\",\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":%q}]}\n\ndata: [DONE]\n\n", finish)
+	}
+	return sse.String()
+}
+
+// streamResult is what a client assembles from a filtered stream
+type streamResult struct {
+	content   string
+	reasoning string
+	calls     []ToolCallDelta // assembled per index, in index order
+	deltas    int             // tool call deltas sent
+	finish    string
+}
+
+// filterStream runs an SSE transcript through the harmony stream filter and
+// assembles the result, checking the deltas are well formed along the way
+func filterStream(t *testing.T, sse string) streamResult {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	out, err := ioutil.ReadAll(newHarmonyStreamFilter(ioutil.NopCloser(strings.NewReader(sse)), newResponseIdentity(req)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res streamResult
+	for _, line := range strings.Split(string(out), "\n") {
+		data := strings.TrimPrefix(line, "data: ")
+		if data == line || data == "[DONE]" {
+			continue
+		}
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		for _, choice := range chunk.Choices {
+			res.content += choice.Delta.Content
+			res.reasoning += choice.Delta.ReasoningContent
+			if choice.FinishReason != nil {
+				res.finish = *choice.FinishReason
+			}
+			for _, d := range choice.Delta.ToolCalls {
+				res.deltas++
+				switch {
+				case d.Index == len(res.calls):
+					if d.ID == "" || d.Function.Name == "" || d.Type != "function" {
+						t.Errorf("first delta of call %d = %+v, want its ID, type and name", d.Index, d)
+					}
+					res.calls = append(res.calls, d)
+				case d.Index == len(res.calls)-1:
+					if d.ID != "" || d.Function.Name != "" {
+						t.Errorf("later delta of call %d repeats its ID or name: %+v", d.Index, d)
+					}
+					res.calls[d.Index].Function.Arguments += d.Function.Arguments
+				default:
+					t.Fatalf("delta for call %d after %d calls", d.Index, len(res.calls))
+				}
+			}
+		}
+	}
+	return res
+}
+
+func TestHarmonyStreamToolCallDeltas(t *testing.T) {
+	useConfig(t, testConfig())
+	const (
+		analysis = "<|channel|>analysis<|message|>Need to read the file.<|end|>"
+		call     = "<|start|>assistant<|channel|>commentary to=functions.read_file <|constrain|>json<|message|>{\"path\": \"main.go\"}<|call|>"
+	)
+	tests := []struct {
+		name      string
+		sse       string
+		reasoning string
+		args      string
+		finish    string
+		minDeltas int // the arguments must arrive incrementally, not in one delta
+	}{
+		{
+			name:      "recorded",
+			sse:       recordedToolCallStream,
+			reasoning: "Need to read the file.",
+			args:      `{"path": "main.go"}`,
+			finish:    "tool_calls",
+			minDeltas: 2,
+		},
+		{
+			name:      "one piece",
+			sse:       sseTranscript("stop", analysis+call),
+			reasoning: "Need to read the file.",
+			args:      `{"path": "main.go"}`,
+			finish:    "tool_calls",
+			minDeltas: 1,
+		},
+		{
+			name:      "a few characters at a time",
+			sse:       sseTranscript("stop", splitRunes(analysis+call, 3)...),
+			reasoning: "Need to read the file.",
+			args:      `{"path": "main.go"}`,
+			finish:    "tool_calls",
+			minDeltas: 5,
+		},
+		{
+			name:      "call without analysis",
+			sse:       sseTranscript("stop", splitRunes(call, 7)...),
+			args:      `{"path": "main.go"}`,
+			finish:    "tool_calls",
+			minDeltas: 3,
+		},
+		{
+			name:      "cut off mid arguments",
+			sse:       sseTranscript("", call[:len(call)-len("main.go\"}<|call|>")]),
+			args:      `{"path": ""}`,
+			finish:    "length",
+			minDeltas: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := filterStream(t, tt.sse)
+			if res.content != "" {
+				t.Errorf("content = %q, want none", res.content)
+			}
+			if res.reasoning != tt.reasoning {
+				t.Errorf("reasoning = %q, want %q", res.reasoning, tt.reasoning)
+			}
+			if len(res.calls) != 1 {
+				t.Fatalf("tool calls = %+v, want one", res.calls)
+			}
+			if got := res.calls[0]; got.Function.Name != "read_file" || got.Function.Arguments != tt.args {
+				t.Errorf("tool call = %s(%s), want read_file(%s)", got.Function.Name, got.Function.Arguments, tt.args)
+			}
+			if res.deltas < tt.minDeltas {
+				t.Errorf("tool call sent in %d deltas, want at least %d", res.deltas, tt.minDeltas)
+			}
+			if res.finish != tt.finish {
+				t.Errorf("finish_reason = %q, want %q", res.finish, tt.finish)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log/slog"
+)
+
+// toolTemperatureTransform replaces the sampling temperature of requests that
+// get the grammar and offer tools with --tool-call-temperature, since gpt-oss
+// emits cleaner tool call JSON at low temperatures
+type toolTemperatureTransform struct{}
+
+func (toolTemperatureTransform) Name() string { return "tool-temperature" }
+
+func (toolTemperatureTransform) TransformRequest(state *requestTransformState) {
+	if config.ToolCallTemperature < 0 || !state.Decision.Injected {
+		return
+	}
+	raw, ok := state.decoded()
+	if !ok {
+		return
+	}
+	if tools, _ := raw["tools"].([]interface{}); len(tools) == 0 {
+		return
+	}
+	applyTemperature(raw, config.ToolCallTemperature, isOllamaNativeChat(state.Path))
+	state.changed()
+	slog.Debug("tool call temperature applied", "temperature", config.ToolCallTemperature)
+}
+
+// applyTemperature sets the temperature where the API reads it: options for
+// native requests, the top level for OpenAI requests. A temperature the
+// client put in the options of an OpenAI request is replaced as well.
+func applyTemperature(raw map[string]interface{}, temperature float64, native bool) {
+	options, _ := raw["options"].(map[string]interface{})
+	if native {
+		if options == nil {
+			options = make(map[string]interface{})
+			raw["options"] = options
+		}
+		options["temperature"] = temperature
+		return
+	}
+	raw["temperature"] = temperature
+	if _, ok := options["temperature"]; ok {
+		options["temperature"] = temperature
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+)
+
+// toolResultTransform names the tool results sent back by the client after
+// the call they answer. gpt-oss expects a tool result as a message from the
+// tool itself (<|start|>functions.NAME to=assistant<|channel|>commentary<|message|>...),
+// which Ollama's template only renders when the message carries the function
+// name, while OpenAI clients identify the call with tool_call_id alone.
+// Naming the message is all the conversion needed: Ollama renders every
+// message through the model's template, so harmony markup written into the
+// content would end up inside the template's own tool message and be read by
+// the model as plain text.
+type toolResultTransform struct{}
+
+func (toolResultTransform) Name() string { return "tool-results" }
+
+func (toolResultTransform) TransformRequest(state *requestTransformState) {
+	if !state.mayContain(`"tool"`) {
+		return
+	}
+	if raw, ok := state.decoded(); ok && applyToolResults(raw, isOllamaNativeChat(state.Path)) {
+		state.changed()
+	}
+}
+
+// applyToolResults sets the function name on every tool message that lacks
+// one, taking it from the assistant call with the message's tool_call_id, or
+// from the first call without a result when the ID doesn't match any call.
+// Native requests get the name in tool_name, OpenAI requests in name.
+// Content sent as an array of parts is joined into a single string.
+// It reports whether any message was changed.
+func applyToolResults(raw map[string]interface{}, native bool) bool {
+	messages, ok := raw["messages"].([]interface{})
+	if !ok {
+		return false
+	}
+	nameKey := "name"
+	if native {
+		nameKey = "tool_name"
+	}
+
+	// Calls of the last assistant turn that didn't get a result yet
+	var pending []pendingToolCall
+	changed := false
+	for _, m := range messages {
+		message, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch message["role"] {
+		case "assistant":
+			pending = pending[:0]
+			calls, _ := message["tool_calls"].([]interface{})
+			for _, c := range calls {
+				pending = append(pending, toolCallName(c))
+			}
+		case "tool":
+			id, _ := message["tool_call_id"].(string)
+			match := 0
+			for i, call := range pending {
+				if id != "" && call.id == id {
+					match = i
+					break
+				}
+			}
+			var name string
+			if match < len(pending) {
+				name = pending[match].name
+				pending = append(pending[:match], pending[match+1:]...)
+			}
+			if current, _ := message[nameKey].(string); current == "" && name != "" {
+				message[nameKey] = name
+				changed = true
+			}
+			if parts, ok := message["content"].([]interface{}); ok {
+				message["content"] = joinContentParts(parts)
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// pendingToolCall is an assistant tool call waiting for its result
+type pendingToolCall struct {
+	id   string
+	name string
+}
+
+// toolCallName returns the ID and function name of a decoded tool call
+func toolCallName(c interface{}) pendingToolCall {
+	call, _ := c.(map[string]interface{})
+	id, _ := call["id"].(string)
+	function, _ := call["function"].(map[string]interface{})
+	name, _ := function["name"].(string)
+	return pendingToolCall{id: id, name: name}
+}
+
+// joinContentParts joins the text of content parts sent as an array
+func joinContentParts(parts []interface{}) string {
+	var texts []string
+	for _, p := range parts {
+		part, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if text, ok := part["text"].(string); ok {
+			texts = append(texts, text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestToolResultTransform(t *testing.T) {
+	const call = `{"role": "assistant", "tool_calls": [{"id": "call_a", "type": "function", "function": {"name": "read_file", "arguments": "{}"}},` +
+		` {"id": "call_b", "type": "function", "function": {"name": "list_files", "arguments": "{}"}}]}`
+	tests := []struct {
+		name string
+		path string
+		body string
+		want []map[string]interface{} // the tool messages expected upstream, nil when the body must be left as sent
+	}{
+		{
+			name: "matched by tool_call_id",
+			path: "/v1/chat/completions",
+			body: `{"messages": [` + call + `, {"role": "tool", "tool_call_id": "call_b", "content": "a.go"}]}`,
+			want: []map[string]interface{}{{"role": "tool", "tool_call_id": "call_b", "name": "list_files", "content": "a.go"}},
+		},
+		{
+			name: "unknown id takes the first pending call",
+			path: "/v1/chat/completions",
+			body: `{"messages": [` + call + `, {"role": "tool", "tool_call_id": "call_x", "content": "1"}, {"role": "tool", "content": "2"}]}`,
+			want: []map[string]interface{}{
+				{"role": "tool", "tool_call_id": "call_x", "name": "read_file", "content": "1"},
+				{"role": "tool", "name": "list_files", "content": "2"},
+			},
+		},
+		{
+			name: "native tool_name",
+			path: "/api/chat",
+			body: `{"messages": [` + call + `, {"role": "tool", "tool_call_id": "call_a", "content": "x"}]}`,
+			want: []map[string]interface{}{{"role": "tool", "tool_call_id": "call_a", "tool_name": "read_file", "content": "x"}},
+		},
+		{
+			name: "content parts joined",
+			path: "/v1/chat/completions",
+			body: `{"messages": [` + call + `, {"role": "tool", "tool_call_id": "call_a", "name": "read_file", "content": [{"type": "text", "text": "a"}, {"type": "text", "text": "b"}]}]}`,
+			want: []map[string]interface{}{{"role": "tool", "tool_call_id": "call_a", "name": "read_file", "content": "a\nb"}},
+		},
+		{
+			name: "already named",
+			path: "/v1/chat/completions",
+			body: `{"messages": [` + call + `, {"role": "tool", "tool_call_id": "call_a", "name": "read_file", "content": "x"}]}`,
+		},
+		{
+			name: "no tool messages",
+			path: "/v1/chat/completions",
+			body: `{"messages": [{"role": "user", "content": "call the tool"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &requestTransformState{Path: tt.path, Body: []byte(tt.body)}
+			toolResultTransform{}.TransformRequest(state)
+			state.encode()
+			if tt.want == nil {
+				if string(state.Body) != tt.body {
+					t.Errorf("unchanged body was rewritten:\n got %s\nwant %s", state.Body, tt.body)
+				}
+				return
+			}
+			var got struct {
+				Messages []map[string]interface{} `json:"messages"`
+			}
+			if err := json.Unmarshal(state.Body, &got); err != nil {
+				t.Fatal(err)
+			}
+			var tools []map[string]interface{}
+			for _, m := range got.Messages {
+				if m["role"] == "tool" {
+					tools = append(tools, m)
+				}
+			}
+			if !reflect.DeepEqual(tools, tt.want) {
+				t.Errorf("tool messages = %v, want %v", tools, tt.want)
+			}
+		})
+	}
+}
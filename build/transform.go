@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// requestTransformState is the request body passed through the request
+// transforms, along with what they decided
+type requestTransformState struct {
+	Path     string
+	Body     []byte
+	Override *grammarSelection // grammar selected by the client through a header
+	Decision rewriteDecision
+
+	raw     map[string]interface{} // Body decoded by decoded, nil until then
+	badBody bool                   // Body is not a JSON object
+	dirty   bool                   // raw was changed and has to be encoded into Body
+}
+
+// decoded returns the body as a JSON object for transforms that edit it in
+// place, decoding it on first use so the transforms share a single decode.
+// Transforms that change it call changed; the body is encoded once, after
+// the last transform.
+func (s *requestTransformState) decoded() (map[string]interface{}, bool) {
+	if s.raw == nil && !s.badBody {
+		raw, err := decodeRawBody(s.Body)
+		s.raw, s.badBody = raw, err != nil
+	}
+	return s.raw, !s.badBody
+}
+
+// changed records that a transform changed the decoded body
+func (s *requestTransformState) changed() {
+	s.dirty = true
+}
+
+// mayContain is the cheap check transforms run before decoding the body: it
+// reports whether the body may hold sub. Once the decoded body has changed
+// the raw bytes are out of date, so it always may.
+func (s *requestTransformState) mayContain(sub string) bool {
+	return s.dirty || bytes.Contains(s.Body, []byte(sub))
+}
+
+// encode writes the decoded body back into Body if a transform changed it.
+// The body is left as it was if it cannot be encoded.
+func (s *requestTransformState) encode() {
+	if !s.dirty {
+		return
+	}
+	s.dirty = false
+	if newBody, err := json.Marshal(s.raw); err == nil {
+		s.Body = newBody
+	}
+}
+
+// RequestTransform rewrites the body of a proxied POST request before it is sent upstream
+type RequestTransform interface {
+	// Name identifies the transform in --disable-transforms
+	Name() string
+	TransformRequest(state *requestTransformState)
+}
+
+// ResponseTransform rewrites an upstream response before it is sent to the client
+type ResponseTransform interface {
+	// Name identifies the transform in --disable-transforms
+	Name() string
+	// Applies reports whether the transform handles the response
+	Applies(resp *http.Response) bool
+	TransformResponse(resp *http.Response) error
+}
+
+// requestTransforms run in order on every proxied POST request body. The
+// grammar transform edits the raw bytes, all the others the shared decoded body.
+var requestTransforms = []RequestTransform{
+	grammarTransform{},
+	roleMapTransform{},
+	assistantHistoryTransform{},
+	stripThinkingTransform{},
+	toolResultTransform{},
+	toolTemperatureTransform{},
+}
+
+// responseTransforms run in order on every upstream response they apply to
+var responseTransforms = []ResponseTransform{
+	upstreamErrorTransform{},
+	modelsTransform{},
+	harmonyStreamTransform{},
+	harmonyTransform{},
+}
+
+// disabledTransforms are the --disable-transforms names (split once at startup)
+var disabledTransforms []string
+
+// transformEnabled reports whether a transform was not disabled with --disable-transforms
+func transformEnabled(name string) bool {
+	for _, disabled := range disabledTransforms {
+		if disabled == name {
+			return false
+		}
+	}
+	return true
+}
+
+// transformNames lists the names of all registered transforms, in order
+func transformNames() []string {
+	var names []string
+	for _, t := range requestTransforms {
+		names = append(names, t.Name())
+	}
+	for _, t := range responseTransforms {
+		names = append(names, t.Name())
+	}
+	return names
+}
+
+// isTransformName reports whether a transform with the given name is registered
+func isTransformName(name string) bool {
+	for _, n := range transformNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// applyRequestTransforms runs the enabled request transforms on a request body
+func applyRequestTransforms(path string, body []byte, override *grammarSelection) ([]byte, rewriteDecision) {
+	return runRequestTransforms(path, body, override, "")
+}
+
+// fallbackRequestBody runs the enabled request transforms except the grammar
+// on a request body, giving the body --fallback-no-grammar retries with
+func fallbackRequestBody(path string, body []byte) []byte {
+	newBody, _ := runRequestTransforms(path, body, nil, grammarTransform{}.Name())
+	return newBody
+}
+
+// runRequestTransforms runs the enabled request transforms other than skip
+func runRequestTransforms(path string, body []byte, override *grammarSelection, skip string) ([]byte, rewriteDecision) {
+	state := &requestTransformState{
+		Path:     path,
+		Body:     body,
+		Override: override,
+		Decision: rewriteDecision{Policy: config.GrammarPolicy},
+	}
+	for _, t := range requestTransforms {
+		if t.Name() != skip && transformEnabled(t.Name()) {
+			t.TransformRequest(state)
+		}
+	}
+	state.encode()
+	return state.Body, state.Decision
+}
+
+// applyResponseTransforms runs the enabled response transforms that apply to a response
+func applyResponseTransforms(resp *http.Response) error {
+	for _, t := range responseTransforms {
+		if !transformEnabled(t.Name()) || !t.Applies(resp) {
+			continue
+		}
+		if err := t.TransformResponse(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grammarTransform injects the grammar, along with the system prefix that
+// only applies to requests getting a grammar
+type grammarTransform struct{}
+
+func (grammarTransform) Name() string { return "grammar" }
+
+func (grammarTransform) TransformRequest(state *requestTransformState) {
+	state.Body, state.Decision = rewriteRequestBody(state.Path, state.Body, state.Override)
+}
+
+// upstreamErrorTransform rewraps upstream errors in the OpenAI error envelope
+type upstreamErrorTransform struct{}
+
+func (upstreamErrorTransform) Name() string { return "upstream-errors" }
+
+func (upstreamErrorTransform) Applies(resp *http.Response) bool {
+	// Clients of the OpenAI-compatible API expect OpenAI shaped errors
+	return resp.StatusCode >= 400 && !isOllamaNativeAPI(resp.Request.URL.Path)
+}
+
+func (upstreamErrorTransform) TransformResponse(resp *http.Response) error {
+	return rewriteUpstreamError(resp)
+}
+
+// modelsTransform annotates model lists with the grammar each model gets
+type modelsTransform struct{}
+
+func (modelsTransform) Name() string { return "models" }
+
+func (modelsTransform) Applies(resp *http.Response) bool {
+	return resp.StatusCode < 400 && isModelsRequest(resp.Request)
+}
+
+func (modelsTransform) TransformResponse(resp *http.Response) error {
+	return annotateModelsResponse(resp)
+}
+
+// harmonyStreamTransform strips harmony markup from streamed completions
+type harmonyStreamTransform struct{}
+
+func (harmonyStreamTransform) Name() string { return "harmony-stream" }
+
+func (harmonyStreamTransform) Applies(resp *http.Response) bool {
+	return resp.StatusCode < 400 && isTransformRequest(resp.Request) && isStreamRequest(resp.Request)
+}
+
+func (harmonyStreamTransform) TransformResponse(resp *http.Response) error {
+	if err := filterStreamWithIdleTimeout(resp); err != nil {
+		return err
+	}
+	compressStream(resp)
+	return nil
+}
+
+// harmonyTransform strips harmony markup from complete completions
+type harmonyTransform struct{}
+
+func (harmonyTransform) Name() string { return "harmony" }
+
+func (harmonyTransform) Applies(resp *http.Response) bool {
+	return resp.StatusCode < 400 && isTransformRequest(resp.Request) && !isStreamRequest(resp.Request)
+}
+
+func (harmonyTransform) TransformResponse(resp *http.Response) error {
+	return rewriteHarmonyResponse(resp)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRequestTransformsShareDecodedBody(t *testing.T) {
+	cfg := testConfig()
+	cfg.DisableTransforms = "grammar"
+	cfg.StripThinking = true
+	useConfig(t, cfg)
+
+	// Every decoded transform has something to change
+	body := `{"model": "gpt-oss:20b", "messages": [` +
+		`{"role": "developer", "content": "Be brief."},` +
+		`{"role": "user", "content": "a"},` +
+		`{"role": "assistant", "content": "<|channel|>final<|message|>b<|return|>", "reasoning_content": "r", "tool_calls": [{"id": "call_a", "type": "function", "function": {"name": "f", "arguments": "{}"}}]},` +
+		`{"role": "tool", "tool_call_id": "call_a", "content": "x"},` +
+		`{"role": "user", "content": "c"}]}`
+	got, _ := applyRequestTransforms("/v1/chat/completions", []byte(body), nil)
+
+	var req struct {
+		Messages []map[string]interface{} `json:"messages"`
+	}
+	if err := json.Unmarshal(got, &req); err != nil {
+		t.Fatalf("invalid body %s: %v", got, err)
+	}
+	if req.Messages[0]["role"] != "system" {
+		t.Errorf("roles: first message = %v, want the system role", req.Messages[0])
+	}
+	if req.Messages[2]["content"] != "b" {
+		t.Errorf("assistant-history: content = %q, want %q", req.Messages[2]["content"], "b")
+	}
+	if _, ok := req.Messages[2]["reasoning_content"]; ok {
+		t.Errorf("strip-thinking: reasoning kept in %v", req.Messages[2])
+	}
+	if req.Messages[3]["name"] != "f" {
+		t.Errorf("tool-results: tool message = %v, want it named f", req.Messages[3])
+	}
+}
+
+func TestRequestTransformsKeepUnchangedBody(t *testing.T) {
+	cfg := testConfig()
+	cfg.DisableTransforms = "grammar"
+	cfg.StripThinking = true
+	cfg.ToolCallTemperature = 0.1
+	useConfig(t, cfg)
+
+	// Spacing a re-encode would lose
+	body := `{"model": "gpt-oss:20b", "messages": [{"role": "user", "content": "a"}, {"role": "assistant", "content": "b"}, {"role": "tool", "name": "f", "content": "x"}]}`
+	if got, _ := applyRequestTransforms("/v1/chat/completions", []byte(body), nil); string(got) != body {
+		t.Errorf("body re-encoded without a change:\n got %s\nwant %s", got, body)
+	}
+}
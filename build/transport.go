@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// retryBaseDelay is the backoff before the first retry, doubled for every further attempt
+const retryBaseDelay = 500 * time.Millisecond
+
+// contextKey is the type of request context keys set by the adapter
+type contextKey int
+
+const (
+	// streamContextKey marks requests whose client asked for a streamed response
+	streamContextKey contextKey = iota
+	// transformContextKey marks requests whose response goes through the harmony transforms
+	transformContextKey
+	// requestIDContextKey holds the request's X-Request-ID
+	requestIDContextKey
+	// modelsContextKey marks model list requests whose response gets annotated
+	modelsContextKey
+	// fallbackBodyContextKey holds the request body without the injected grammar
+	fallbackBodyContextKey
+	// debugContextKey holds the exchange recorded for /debug/last-request
+	debugContextKey
+	// modelContextKey holds the model named in the request body
+	modelContextKey
+	// grammarContextKey holds the grammar injected into the request body
+	grammarContextKey
+)
+
+// isStreamRequest reports whether the request was marked as streaming by the handler
+func isStreamRequest(r *http.Request) bool {
+	stream, _ := r.Context().Value(streamContextKey).(bool)
+	return stream
+}
+
+// isTransformRequest reports whether the handler marked the request for response transforms
+func isTransformRequest(r *http.Request) bool {
+	transform, _ := r.Context().Value(transformContextKey).(bool)
+	return transform
+}
+
+// isModelsRequest reports whether the handler marked the request for model list annotation
+func isModelsRequest(r *http.Request) bool {
+	models, _ := r.Context().Value(modelsContextKey).(bool)
+	return models
+}
+
+// upstreamTransport is the transport shared by all proxied requests
+var upstreamTransport http.RoundTripper = http.DefaultTransport
+
+// newUpstreamTransport builds the transport used to reach the upstream.
+// Only connection setup and response headers are bounded here, so long
+// running streams are not cut off by the transport.
+func newUpstreamTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+	// The stdlib keeps only 2 idle connections per host, too few for one busy Ollama
+	transport.MaxIdleConns = config.MaxIdleConns
+	transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = config.IdleConnTimeout
+
+	tlsConfig, err := upstreamTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// upstreamTLSConfig returns the TLS settings for HTTPS upstreams: the system
+// roots plus the --upstream-ca-file certificates, or no verification at all
+// with --upstream-insecure-skip-verify. It returns nil for the defaults.
+func upstreamTLSConfig() (*tls.Config, error) {
+	if config.UpstreamCAFile == "" && !config.UpstreamInsecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+	if config.UpstreamCAFile != "" {
+		pem, err := os.ReadFile(config.UpstreamCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading upstream CA file: %v", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in upstream CA file %s", config.UpstreamCAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if config.UpstreamInsecureSkipVerify {
+		slog.Warn("upstream TLS certificates are not verified")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
+
+// retryTransport retries upstream connection errors and 502/503/504 responses
+// with exponential backoff. Streaming requests are never retried because a
+// stream cannot be replayed once it has started.
+type retryTransport struct {
+	next       http.RoundTripper
+	maxRetries int
+	baseDelay  time.Duration
+}
+
+// isRetryableStatus reports whether an upstream status is worth retrying
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.maxRetries <= 0 || isStreamRequest(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	body, err := bufferRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	delay := t.baseDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(replayRequest(req, body))
+		retryable := err != nil || isRetryableStatus(resp.StatusCode)
+		if !retryable || attempt >= t.maxRetries || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			resp.Body.Close()
+		}
+		requestLogger(req.Context()).Warn("retrying upstream request",
+			"method", req.Method,
+			"path", req.URL.Path,
+			"attempt", attempt+1,
+			"max_retries", t.maxRetries,
+			"reason", reason,
+			"backoff", delay)
+
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		delay *= 2
+	}
+}
+
+// bufferRequestBody reads the request body so it can be replayed on every
+// attempt. Requests without a body return nil.
+func bufferRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	return body, err
+}
+
+// replayRequest returns a copy of the request for another attempt, sending body
+func replayRequest(req *http.Request, body []byte) *http.Request {
+	attemptReq := req.Clone(req.Context())
+	if body != nil {
+		attemptReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		attemptReq.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	return attemptReq
+}
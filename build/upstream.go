@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Load balancing strategies across multiple targets (--balance flag)
+const (
+	balanceRoundRobin = "round-robin"
+	balanceRandom     = "random"
+	balanceModel      = "model"
+)
+
+// upstream is a proxy target together with the reverse proxy built for it at startup
+type upstream struct {
+	target *url.URL
+	proxy  *httputil.ReverseProxy
+}
+
+// upstreams are the configured targets, in the order they were given
+var upstreams []*upstream
+
+// upstreamsByTarget finds the upstream for a target returned by the selector
+var upstreamsByTarget = make(map[*url.URL]*upstream)
+
+// selector is the balancing strategy chosen with --balance
+var selector targetSelector
+
+// targetSelector picks the upstream target for a request
+type targetSelector interface {
+	selectTarget(req *ChatCompletionRequest) *url.URL
+}
+
+// roundRobinSelector cycles through the targets in order
+type roundRobinSelector struct {
+	targets []*url.URL
+	counter uint64
+}
+
+func (s *roundRobinSelector) selectTarget(req *ChatCompletionRequest) *url.URL {
+	n := atomic.AddUint64(&s.counter, 1) - 1
+	return s.targets[n%uint64(len(s.targets))]
+}
+
+// randomSelector picks a random target for every request
+type randomSelector struct {
+	targets []*url.URL
+}
+
+func (s *randomSelector) selectTarget(req *ChatCompletionRequest) *url.URL {
+	return s.targets[rand.Intn(len(s.targets))]
+}
+
+// modelSelector sends every request for a model to the same target, so a
+// model stays loaded on one backend. Requests without a model use the fallback.
+type modelSelector struct {
+	targets  []*url.URL
+	fallback targetSelector
+}
+
+func (s *modelSelector) selectTarget(req *ChatCompletionRequest) *url.URL {
+	if req == nil || req.Model == "" {
+		return s.fallback.selectTarget(req)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(req.Model))
+	return s.targets[h.Sum32()%uint32(len(s.targets))]
+}
+
+// newTargetSelector builds the selector for a balancing strategy
+func newTargetSelector(strategy string, targets []*url.URL) targetSelector {
+	switch strategy {
+	case balanceRandom:
+		return &randomSelector{targets: targets}
+	case balanceModel:
+		return &modelSelector{targets: targets, fallback: &roundRobinSelector{targets: targets}}
+	default:
+		return &roundRobinSelector{targets: targets}
+	}
+}
+
+// setupUpstreams builds one reverse proxy per target and the balancing strategy
+func setupUpstreams(targets []*url.URL, strategy string) {
+	upstreams = nil
+	upstreamsByTarget = make(map[*url.URL]*upstream)
+	for _, target := range targets {
+		up := newUpstream(target)
+		upstreams = append(upstreams, up)
+		upstreamsByTarget[target] = up
+	}
+	selector = newTargetSelector(strategy, targets)
+}
+
+// parseTargets splits a comma-separated list of upstream base URLs
+func parseTargets(list string) ([]*url.URL, error) {
+	var targets []*url.URL
+	for _, raw := range strings.Split(list, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		// "ollama:11434" would parse with "ollama" as the scheme
+		if !strings.Contains(raw, "://") {
+			fmt.Fprintf(os.Stderr, "Warning: target URL %q has no scheme, using http://%s\n", raw, raw)
+			raw = "http://" + raw
+		}
+		target, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target URL %q: %v", raw, err)
+		}
+		if target.Scheme != "http" && target.Scheme != "https" {
+			return nil, fmt.Errorf("invalid target URL %q: scheme must be http or https", raw)
+		}
+		if target.Host == "" {
+			return nil, fmt.Errorf("invalid target URL %q: missing host", raw)
+		}
+		targets = append(targets, target)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no target URL configured")
+	}
+	return targets, nil
+}
+
+// newUpstream builds the reverse proxy for a target
+func newUpstream(target *url.URL) *upstream {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		rewriteUpstreamPath(req.URL, config.StripPrefix, config.TargetPathPrefix)
+		director(req)
+		stripAdapterHeaders(req.Header)
+		// The adapter answers CORS itself, the upstream would check the origin again
+		if len(corsOrigins) > 0 {
+			req.Header.Del("Origin")
+		}
+		// Upstreams behind a virtual host or TLS SNI need their own host name
+		if !config.PreserveHost {
+			req.Host = target.Host
+		}
+	}
+	proxy.Transport = upstreamTransport
+	proxy.ModifyResponse = modifyResponse
+	proxy.ErrorHandler = proxyErrorHandler(target)
+	return &upstream{target: target, proxy: proxy}
+}
+
+// adapterHeaderPrefix marks control headers meant for the adapter only
+const adapterHeaderPrefix = "X-Adapter-"
+
+// stripAdapterHeaders removes the adapter's control headers so they never reach
+// the upstream. Hop-by-hop headers (Connection and the headers it lists,
+// Keep-Alive, TE, Upgrade, ...) are removed by the reverse proxy itself per RFC 7230.
+func stripAdapterHeaders(h http.Header) {
+	for name := range h {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), adapterHeaderPrefix) {
+			h.Del(name)
+		}
+	}
+}
+
+// rewriteUpstreamPath removes the strip prefix from the request path and
+// prepends the target prefix. The strip prefix only matches whole segments, so
+// "/ollama" is removed from "/ollama/v1" but not from "/ollamax". Both are
+// applied before the path of the target URL itself is joined in.
+func rewriteUpstreamPath(u *url.URL, strip, prefix string) {
+	if strip == "" && prefix == "" {
+		return
+	}
+	p := u.Path
+	if strip = strings.TrimRight(strip, "/"); strip != "" {
+		if p == strip {
+			p = "/"
+		} else if strings.HasPrefix(p, strip+"/") {
+			p = strings.TrimPrefix(p, strip)
+		}
+	}
+	if prefix = strings.TrimRight(prefix, "/"); prefix != "" {
+		p = prefix + p
+	}
+	u.Path = p
+	// The escaped form no longer matches, it is derived from Path again
+	u.RawPath = ""
+}
+
+// isUpgradeRequest reports whether the client asks to switch protocols
+// (e.g. to WebSocket). Such requests are proxied without touching the body.
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, option := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(option), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// proxyErrorHandler answers failed upstream requests with an OpenAI style 502
+// instead of the reverse proxy's empty "Bad Gateway" response
+func proxyErrorHandler(target *url.URL) func(http.ResponseWriter, *http.Request, error) {
+	safeTarget := *target
+	safeTarget.User = nil
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		requestLogger(r.Context()).Error("upstream request failed",
+			"target", safeTarget.String(),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"error", err)
+		writeAPIError(w, http.StatusBadGateway, "upstream_unreachable",
+			fmt.Sprintf("upstream Ollama unreachable at %s", safeTarget.String()))
+	}
+}
+
+// selectUpstream picks the upstream for a request according to the balancing strategy
+func selectUpstream(req *ChatCompletionRequest) *upstream {
+	if len(upstreams) == 1 {
+		return upstreams[0]
+	}
+	return upstreamsByTarget[selector.selectTarget(req)]
+}
+
+// passthroughPaths are the --passthrough-paths prefixes (split once at startup)
+var passthroughPaths []string
+
+// defaultInjectPaths are the chat endpoints of the OpenAI-compatible and the native API
+const defaultInjectPaths = "/v1/chat/completions,/api/chat"
+
+// injectPaths are the --inject-paths endpoints (split once at startup)
+var injectPaths []string
+
+// isInjectPath reports whether a request path is one of the endpoints that
+// get the grammar and the other rewrites. Paths match by suffix, so the
+// endpoints also match behind a client side path prefix.
+func isInjectPath(path string) bool {
+	path = strings.TrimRight(path, "/")
+	for _, endpoint := range injectPaths {
+		if strings.HasSuffix(path, strings.TrimRight(endpoint, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPassthroughPath reports whether a request path may be proxied. Without
+// --passthrough-paths every path is.
+func isPassthroughPath(path string) bool {
+	if len(passthroughPaths) == 0 {
+		return true
+	}
+	for _, prefix := range passthroughPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
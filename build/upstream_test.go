@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestModelSelectorIsSticky(t *testing.T) {
+	targets, err := parseTargets("http://a:11434,http://b:11434,http://c:11434")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTargetSelector(balanceModel, targets)
+	// A second selector over the same targets, as after a restart
+	again := newTargetSelector(balanceModel, targets)
+
+	models := []string{"gpt-oss:20b", "gpt-oss:120b", "qwen3:32b", "llama3.1:8b", "x"}
+	used := make(map[*url.URL]bool)
+	for _, model := range models {
+		t.Run(model, func(t *testing.T) {
+			req := &ChatCompletionRequest{Model: model}
+			first := s.selectTarget(req)
+			for i := 0; i < 10; i++ {
+				if got := s.selectTarget(req); got != first {
+					t.Fatalf("request %d for %s went to %s, first went to %s", i, model, got, first)
+				}
+			}
+			if got := again.selectTarget(req); got != first {
+				t.Errorf("a new selector sends %s to %s, want %s", model, got, first)
+			}
+			used[first] = true
+		})
+	}
+	if len(used) < 2 {
+		t.Errorf("%d models all went to one target", len(models))
+	}
+}
+
+func TestModelSelectorFallsBackWithoutModel(t *testing.T) {
+	targets, err := parseTargets("http://a:11434,http://b:11434")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTargetSelector(balanceModel, targets)
+	// Requests without a model round-robin rather than pile onto one target
+	for _, req := range []*ChatCompletionRequest{nil, {}} {
+		if a, b := s.selectTarget(req), s.selectTarget(req); a == b {
+			t.Errorf("two requests without a model both went to %s", a)
+		}
+	}
+}
+
+// benchmarkProxy sends chat requests through the proxy returned by proxyFor
+// to a local upstream that answers with a small completion
+func benchmarkProxy(b *testing.B, proxyFor func(target string) *upstream) {
+	useConfig(b, testConfig())
+	saved := upstreamTransport
+	b.Cleanup(func() { upstreamTransport = saved })
+	transport, err := newUpstreamTransport()
+	if err != nil {
+		b.Fatal(err)
+	}
+	upstreamTransport = transport
+
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(fakeCompletion))
+	}))
+	b.Cleanup(ollama.Close)
+	target := ollama.URL + "/v1"
+
+	const body = `{"model":"gpt-oss:20b","messages":[{"role":"user","content":"hi"}]}`
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		proxyFor(target).proxy.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			b.Fatalf("status = %d", rec.Code)
+		}
+	}
+}
+
+// BenchmarkSharedProxy reuses the proxy built at startup, as the adapter does
+func BenchmarkSharedProxy(b *testing.B) {
+	var shared *upstream
+	benchmarkProxy(b, func(target string) *upstream {
+		if shared == nil {
+			targets, _ := parseTargets(target)
+			shared = newUpstream(targets[0])
+		}
+		return shared
+	})
+}
+
+// BenchmarkPerRequestProxy parses the target and builds the proxy for every
+// request, as the adapter did before the proxy was shared
+func BenchmarkPerRequestProxy(b *testing.B) {
+	benchmarkProxy(b, func(target string) *upstream {
+		u, err := url.Parse(target)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return newUpstream(u)
+	})
+}
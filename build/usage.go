@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+)
+
+// charsPerToken approximates the number of completion tokens from the text
+// length when the upstream doesn't count them
+const charsPerToken = 4
+
+// streamUsage accumulates the token usage of a streamed response, which
+// upstreams report in the last chunk only, or not at all
+type streamUsage struct {
+	usage  Usage
+	chunks int  // chunks seen
+	chars  int  // completion characters seen
+	sent   bool // the consolidated usage frame was written
+}
+
+// addChunk records the completion text and usage of a parsed chunk.
+// Upstreams sending usage more than once report running totals, so the
+// largest count wins.
+func (u *streamUsage) addChunk(chunk *ChatCompletionChunk) {
+	u.chunks++
+	for _, choice := range chunk.Choices {
+		u.chars += utf8.RuneCountInString(choice.Delta.Content)
+	}
+	if chunk.Usage == nil {
+		return
+	}
+	if chunk.Usage.PromptTokens > u.usage.PromptTokens {
+		u.usage.PromptTokens = chunk.Usage.PromptTokens
+	}
+	if chunk.Usage.CompletionTokens > u.usage.CompletionTokens {
+		u.usage.CompletionTokens = chunk.Usage.CompletionTokens
+	}
+}
+
+// total returns the usage to report, estimating the completion tokens from
+// the streamed text when the upstream didn't count them
+func (u *streamUsage) total() Usage {
+	usage := u.usage
+	if usage.CompletionTokens == 0 && u.chars > 0 {
+		usage.CompletionTokens = (u.chars + charsPerToken - 1) / charsPerToken
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return usage
+}
+
+// writeUsage sends the consolidated usage of the stream as a chunk without
+// choices, the way OpenAI reports usage for stream_options.include_usage.
+// It only does so with --stream-usage, once, and for streams that had chunks.
+func (f *harmonyStreamFilter) writeUsage() {
+	if !config.StreamUsage || f.usage.sent || f.usage.chunks == 0 {
+		return
+	}
+	f.usage.sent = true
+
+	usage := f.usage.total()
+	chunk := ChatCompletionChunk{
+		ID:                f.last.ID,
+		Object:            f.last.Object,
+		Created:           f.last.Created,
+		Model:             f.last.Model,
+		SystemFingerprint: f.last.SystemFingerprint,
+		Choices:           []ChunkChoice{},
+		Usage:             &usage,
+	}
+	out, err := json.Marshal(chunk)
+	if err != nil {
+		return
+	}
+	f.out.WriteString("data: ")
+	f.out.Write(out)
+	f.out.WriteString("\n\n")
+}